@@ -0,0 +1,744 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/client"
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/server"
+	"github.com/destruc7i0n/webpush-api/store"
+
+	"github.com/google/uuid"
+)
+
+const usage = `usage: webpush-api [flags] <command> [args]
+
+Commands:
+  serve                 run the API server (the default)
+  topics ls             list topics
+  subs ls <topic>       list the subscriptions of a topic
+  subs import [file]    bulk import raw browser subscriptions from JSON
+                        lines or CSV
+  push <topic>          send a notification, queued until the server starts with -db
+  keys export [file]    write the VAPID keys as JSON
+  keys import [file]    replace the VAPID keys with JSON ones
+  keys add [file]       add a key pair imported subscriptions were made with
+  vapid rotate          generate new VAPID keys, keeping the previous pair
+                        for the existing subscriptions
+  db compact            rewrite the database file without stale entries
+  db backup <file>      write a consistent copy of the database
+  db export [file]      write keys, topics, subscriptions and pending
+                        notifications as JSON lines
+  db import [file]      read an export, -merge keeps existing records and
+                        skips subscriptions whose endpoint already exists
+  db migrate            upgrade the database to this build's schema version
+  db quarantine         list the records that failed to decode
+  db rotate-key         encrypt the secrets with a new master key from
+                        -new-key-file, or -decrypt them
+
+Commands work against the running API with -api, and directly on the
+database file otherwise. Only use the database file while the server is
+stopped. keys export/import, vapid, db compact, db migrate and db
+rotate-key only work on the database file, which commands migrate and
+decrypt with ENCRYPTION_KEY or ENCRYPTION_KEY_FILE when they open it;
+subs ls, subs import, keys add and db backup, export, import and
+quarantine need -admin-key with -api.
+
+Flags:
+`
+
+var errUsage = errors.New("invalid usage")
+
+// cli runs the admin commands, against the API when api is set.
+type cli struct {
+	api    *client.Client
+	dbPath string
+	out    io.Writer
+}
+
+func runCLI(args []string) error {
+	flags := flag.NewFlagSet("webpush-api", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	apiURL := flags.String("api", os.Getenv("WEBPUSH_API_URL"), "URL of the running API, e.g. http://localhost:8080")
+	apiKey := flags.String("api-key", os.Getenv("WEBPUSH_API_KEY"), "X-API-Key sent to the API")
+	adminKey := flags.String("admin-key", os.Getenv("WEBPUSH_ADMIN_KEY"), "X-Admin-Key sent to the API")
+	dbPath := flags.String("db", dbPathFromEnv(), "database file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	c := &cli{dbPath: *dbPath, out: os.Stdout}
+	if *apiURL != "" {
+		c.api = client.New(*apiURL, client.WithAPIKey(*apiKey), client.WithAdminKey(*adminKey))
+	}
+
+	err := c.run(flags.Args())
+	if err == errUsage {
+		flags.Usage()
+	}
+	return err
+}
+
+func (c *cli) run(args []string) error {
+	if len(args) == 0 {
+		return serve(c.dbPath)
+	}
+
+	command, args := args[0], args[1:]
+	sub := ""
+	if len(args) > 0 {
+		sub = args[0]
+	}
+
+	switch {
+	case command == "serve":
+		return serve(c.dbPath)
+	case command == "topics" && sub == "ls":
+		return c.topicsLs(args[1:])
+	case command == "subs" && sub == "ls":
+		return c.subsLs(args[1:])
+	case command == "subs" && sub == "import":
+		return c.subsImport(args[1:])
+	case command == "push":
+		return c.push(args)
+	case command == "keys" && sub == "export":
+		return c.keysExport(args[1:])
+	case command == "keys" && sub == "import":
+		return c.keysImport(args[1:])
+	case command == "keys" && sub == "add":
+		return c.keysAdd(args[1:])
+	case command == "vapid" && sub == "rotate":
+		return c.vapidRotate(args[1:])
+	case command == "db" && sub == "compact":
+		return c.dbCompact()
+	case command == "db" && sub == "backup":
+		return c.dbBackup(args[1:])
+	case command == "db" && sub == "export":
+		return c.dbExport(args[1:])
+	case command == "db" && sub == "import":
+		return c.dbImport(args[1:])
+	case command == "db" && sub == "migrate":
+		return c.dbMigrate()
+	case command == "db" && sub == "quarantine":
+		return c.dbQuarantine()
+	case command == "db" && sub == "rotate-key":
+		return c.dbRotateKey(args[1:])
+	}
+	return errUsage
+}
+
+// openStore opens the database file for the commands that need it.
+func (c *cli) openStore() (*store.Store, error) {
+	if _, err := os.Stat(c.dbPath); err != nil {
+		return nil, fmt.Errorf("database %s: %w", c.dbPath, err)
+	}
+	return openStore(c.dbPath)
+}
+
+// fileOnly opens the database file, refusing to run against the API.
+func (c *cli) fileOnly(command string) (*store.Store, error) {
+	if c.api != nil {
+		return nil, fmt.Errorf("%s only works on the database file, drop -api", command)
+	}
+	return c.openStore()
+}
+
+func (c *cli) topicsLs(args []string) error {
+	flags := flag.NewFlagSet("topics ls", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "only topics starting with prefix")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var topics []client.TopicSummary
+	if c.api != nil {
+		opts := &client.ListOptions{Limit: 500}
+		for {
+			resp, err := c.api.ListTopics(context.Background(), *prefix, nil, opts)
+			if err != nil {
+				return err
+			}
+			topics = append(topics, resp.Topics...)
+			if resp.Next == "" {
+				break
+			}
+			opts.Cursor = resp.Next
+		}
+	} else {
+		s, err := c.openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		after := ""
+		for {
+			names, next, err := s.GetTopics(*prefix, after, 500, nil)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				topic, err := s.GetTopic(name)
+				if err == store.ErrNotFound {
+					topic = push.Topic{ID: name}
+				} else if err != nil {
+					return err
+				}
+				count, err := s.CountSubscriptions(name)
+				if err != nil {
+					return err
+				}
+				topics = append(topics, client.TopicSummary{Topic: topic, Subscriptions: count})
+			}
+			if next == "" {
+				break
+			}
+			after = next
+		}
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tSUBSCRIPTIONS\tARCHIVED\tNAME")
+	for _, topic := range topics {
+		fmt.Fprintf(w, "%s\t%d\t%t\t%s\n", topic.ID, topic.Subscriptions, topic.Archived, topic.Name)
+	}
+	return w.Flush()
+}
+
+func (c *cli) subsLs(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	topic := args[0]
+
+	var subscriptions []push.Subscription
+	if c.api != nil {
+		opts := &client.ListOptions{Limit: 500}
+		for {
+			resp, err := c.api.ListSubscriptions(context.Background(), topic, nil, opts)
+			if err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, resp.Subscriptions...)
+			if resp.Next == "" {
+				break
+			}
+			opts.Cursor = resp.Next
+		}
+	} else {
+		s, err := c.openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		subscriptions, err = s.GetSubscriptions(topic)
+		if err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTOPIC\tTIMEZONE\tFAILURES\tFLAGGED\tENDPOINT")
+	for _, sub := range subscriptions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%t\t%s\n", sub.ID, sub.Topic, sub.Timezone, sub.Failures, sub.Flagged, sub.Endpoint)
+	}
+	return w.Flush()
+}
+
+func (c *cli) subsImport(args []string) error {
+	flags := flag.NewFlagSet("subs import", flag.ContinueOnError)
+	topic := flags.String("topic", "", "topic of the lines that don't name one")
+	format := flags.String("format", "jsonl", "jsonl or csv")
+	vapidKey := flags.String("vapid-key", "", "public key of the key pair the subscriptions were made with, see keys add")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	in := io.Reader(os.Stdin)
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var result server.SubscriptionImportResult
+	if c.api != nil {
+		resp, err := c.api.ImportSubscriptions(context.Background(), in, &client.SubscriptionImportOptions{
+			Format:   *format,
+			Topic:    *topic,
+			VapidKey: *vapidKey,
+		})
+		if err != nil {
+			return err
+		}
+		result.Imported, result.Skipped = resp.Imported, resp.Skipped
+		for _, e := range resp.Errors {
+			result.Errors = append(result.Errors, store.ImportError{Line: e.Line, Message: e.Message})
+		}
+	} else {
+		err := c.withStore(func(s *store.Store) (err error) {
+			result, err = server.ImportSubscriptions(s, in, server.SubscriptionImport{
+				Format:       server.ImportFormat(*format),
+				Topic:        *topic,
+				VapidKey:     *vapidKey,
+				AllowedHosts: server.ConfigFromEnv().PushHostAllowlist,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range result.Errors {
+		fmt.Fprintf(c.out, "line %d: %s\n", e.Line, e.Message)
+	}
+	fmt.Fprintf(c.out, "%d imported, %d already subscribed, %d failed\n", result.Imported, result.Skipped, len(result.Errors))
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("subs import: %d lines failed", len(result.Errors))
+	}
+	return nil
+}
+
+func (c *cli) push(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errUsage
+	}
+	topic := args[0]
+
+	flags := flag.NewFlagSet("push", flag.ContinueOnError)
+	title := flags.String("title", "", "notification title (required)")
+	body := flags.String("body", "", "notification body")
+	icon := flags.String("icon", "", "icon URL")
+	redirect := flags.String("redirect", "", "URL opened on click")
+	scheduled := flags.String("scheduled", "", "RFC 3339 time to send at")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *title == "" {
+		return fmt.Errorf("push: -title is required")
+	}
+
+	payload := push.PushPayload{Title: *title, Body: *body, Icon: *icon, Redirect: *redirect}
+
+	if c.api != nil {
+		resp, err := c.api.Push(context.Background(), topic, &client.PushRequest{
+			PushPayload: payload,
+			Scheduled:   *scheduled,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "%s %s\n", resp.ID, resp.Message)
+		return nil
+	}
+
+	var sendAt time.Time
+	if *scheduled != "" {
+		t, err := time.Parse(time.RFC3339, *scheduled)
+		if err != nil {
+			return fmt.Errorf("push: -scheduled must be an RFC 3339 time")
+		}
+		sendAt = t.UTC()
+	}
+
+	s, err := c.openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// the server sends the notification when it loads it on start
+	options := push.NotificationOptions{TTL: 30, Urgency: "normal"}
+	if registered, err := s.GetTopic(topic); err == nil {
+		if registered.Archived {
+			return fmt.Errorf("push: topic %s is archived", topic)
+		}
+		if registered.Defaults.TTL != 0 {
+			options.TTL = registered.Defaults.TTL
+		}
+		if registered.Defaults.Urgency != "" {
+			options.Urgency = registered.Defaults.Urgency
+		}
+		if payload.Icon == "" {
+			payload.Icon = registered.Defaults.Icon
+		}
+	} else if err != store.ErrNotFound {
+		return err
+	}
+
+	notification := push.Notification{
+		Topic:   topic,
+		ID:      uuid.New().String(),
+		Time:    sendAt,
+		Payload: payload,
+		Options: options,
+	}
+	if err := s.AddNotification(topic, notification); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%s notification queued until the server starts\n", notification.ID)
+	return nil
+}
+
+func (c *cli) keysExport(args []string) error {
+	s, err := c.fileOnly("keys export")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	keys, err := s.GetVapidKeys()
+	if err != nil {
+		return fmt.Errorf("keys export: %w", err)
+	}
+
+	out := c.out
+	if len(args) > 0 {
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(keys)
+}
+
+func (c *cli) keysImport(args []string) error {
+	in := io.Reader(os.Stdin)
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var keys push.VapidKeys
+	if err := json.NewDecoder(in).Decode(&keys); err != nil {
+		return fmt.Errorf("keys import: %w", err)
+	}
+	if err := push.ValidateVapidKeys(keys); err != nil {
+		return fmt.Errorf("keys import: %w", err)
+	}
+
+	s, err := c.fileOnly("keys import")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.SetVapidKeys(keys); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "VAPID keys imported, existing subscriptions only work with the key they were made with")
+	return nil
+}
+
+func (c *cli) keysAdd(args []string) error {
+	in := io.Reader(os.Stdin)
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var keys push.VapidKeys
+	if err := json.NewDecoder(in).Decode(&keys); err != nil {
+		return fmt.Errorf("keys add: %w", err)
+	}
+	if err := push.ValidateVapidKeys(keys); err != nil {
+		return fmt.Errorf("keys add: %w", err)
+	}
+
+	if c.api != nil {
+		if _, err := c.api.AddVapidKeys(context.Background(), keys); err != nil {
+			return err
+		}
+	} else {
+		err := c.withStore(func(s *store.Store) error { return s.AddVapidKeyPair(keys) })
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(c.out, "added VAPID key pair %s\n", keys.VAPIDPublicKey)
+	return nil
+}
+
+func (c *cli) vapidRotate(args []string) error {
+	flags := flag.NewFlagSet("vapid rotate", flag.ContinueOnError)
+	flags.Bool("yes", false, "no longer needed, the previous key pair is kept")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := c.fileOnly("vapid rotate")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// existing subscriptions are bound to the previous public key, which is
+	// kept for sending to them
+	keys := push.GenerateVAPIDKeys()
+	marked, err := s.RotateVapidKeys(keys)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "new VAPID public key: %s\n", keys.VAPIDPublicKey)
+	fmt.Fprintf(c.out, "kept the previous key pair for %d existing subscriptions\n", marked)
+	return nil
+}
+
+func (c *cli) dbCompact() error {
+	s, err := c.fileOnly("db compact")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Compact()
+}
+
+func (c *cli) dbBackup(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if c.api != nil {
+		err = c.api.Backup(context.Background(), f)
+	} else {
+		err = c.withStore(func(s *store.Store) error { return s.Backup(f) })
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(args[0])
+		return err
+	}
+	return f.Close()
+}
+
+func (c *cli) dbExport(args []string) error {
+	out := c.out
+	if len(args) > 0 {
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if c.api != nil {
+		return c.api.Export(context.Background(), out)
+	}
+	return c.withStore(func(s *store.Store) error { return s.Export(out) })
+}
+
+func (c *cli) dbImport(args []string) error {
+	flags := flag.NewFlagSet("db import", flag.ContinueOnError)
+	merge := flags.Bool("merge", false, "keep existing records and skip subscriptions whose endpoint already exists")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	in := io.Reader(os.Stdin)
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var result store.ImportResult
+	if c.api != nil {
+		resp, err := c.api.Import(context.Background(), in, *merge)
+		if err != nil {
+			return err
+		}
+		for _, e := range resp.Errors {
+			result.Errors = append(result.Errors, store.ImportError{Line: e.Line, Message: e.Message})
+		}
+		result.Imported = make(map[store.RecordType]int)
+		result.Skipped = make(map[store.RecordType]int)
+		for kind, count := range resp.Imported {
+			result.Imported[store.RecordType(kind)] = count
+		}
+		for kind, count := range resp.Skipped {
+			result.Skipped[store.RecordType(kind)] = count
+		}
+	} else {
+		// restoring into a new instance creates the database file
+		s, err := openStore(c.dbPath)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		result, err = s.Import(in, *merge)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range result.Errors {
+		fmt.Fprintf(c.out, "line %d: %s\n", e.Line, e.Message)
+	}
+	for _, kind := range []store.RecordType{store.RecordVapidKeys, store.RecordVapidKeyPair, store.RecordTopic, store.RecordSubscription, store.RecordNotification} {
+		fmt.Fprintf(c.out, "%s: %d imported, %d skipped\n", kind, result.Imported[kind], result.Skipped[kind])
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("db import: %d lines failed", len(result.Errors))
+	}
+	return nil
+}
+
+func (c *cli) dbMigrate() error {
+	// opening the database file migrates it
+	s, err := c.fileOnly("db migrate")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "schema version %d\n", version)
+	return nil
+}
+
+func (c *cli) dbRotateKey(args []string) error {
+	flags := flag.NewFlagSet("db rotate-key", flag.ContinueOnError)
+	newKeyFile := flags.String("new-key-file", "", "file with the new base64 master key")
+	generate := flags.Bool("generate", false, "write a new random master key to -new-key-file first")
+	decrypt := flags.Bool("decrypt", false, "decrypt the secrets instead, for running without a master key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *decrypt == (*newKeyFile != "") {
+		return fmt.Errorf("db rotate-key: pass either -new-key-file or -decrypt")
+	}
+	if *generate && *newKeyFile == "" {
+		return fmt.Errorf("db rotate-key: -generate needs -new-key-file")
+	}
+
+	// opening the database file decrypts it with the current master key
+	s, err := c.fileOnly("db rotate-key")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var masterKey []byte
+	if *newKeyFile != "" {
+		if *generate {
+			if err := writeMasterKey(*newKeyFile); err != nil {
+				return err
+			}
+		}
+		if masterKey, err = readMasterKey(*newKeyFile); err != nil {
+			return err
+		}
+	}
+
+	count, err := s.Rekey(masterKey)
+	if err != nil {
+		return err
+	}
+	if masterKey == nil {
+		fmt.Fprintf(c.out, "decrypted the secrets of %d records, unset ENCRYPTION_KEY and ENCRYPTION_KEY_FILE before starting the server\n", count)
+	} else {
+		fmt.Fprintf(c.out, "encrypted the secrets of %d records, set ENCRYPTION_KEY_FILE to %s and unset ENCRYPTION_KEY, which is read first, or set it to the new key before starting the server\n", count, *newKeyFile)
+	}
+	return nil
+}
+
+// writeMasterKey writes a new master key to a file only its owner can read,
+// never replacing an existing one.
+func writeMasterKey(path string) error {
+	key, err := store.GenerateMasterKey()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, key); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *cli) dbQuarantine() error {
+	var records []store.Quarantined
+	if c.api != nil {
+		resp, err := c.api.Quarantined(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, record := range resp.Records {
+			records = append(records, store.Quarantined(record))
+		}
+	} else {
+		err := c.withStore(func(s *store.Store) (err error) {
+			records, err = s.GetQuarantined()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tQUARANTINED\tERROR")
+	for _, record := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", record.Key, record.QuarantinedAt.Format(time.RFC3339), record.Error)
+	}
+	return w.Flush()
+}
+
+// withStore runs fn on the database file.
+func (c *cli) withStore(fn func(s *store.Store) error) error {
+	s, err := c.openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return fn(s)
+}
@@ -0,0 +1,342 @@
+// Package client is a typed client for the webpush-api HTTP API, as described
+// by the OpenAPI specification served at /api/openapi.json. Its tests fail on
+// operations of the specification the client has no method for.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+	adminKey   string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http client.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithAPIKey sends the key as the X-API-Key header on every request.
+func WithAPIKey(apiKey string) Option {
+	return func(c *Client) {
+		c.apiKey = apiKey
+	}
+}
+
+// WithAdminKey sends the key as the X-Admin-Key header, for the admin routes.
+func WithAdminKey(adminKey string) Option {
+	return func(c *Client) {
+		c.adminKey = adminKey
+	}
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Client) VapidKey(ctx context.Context) (*VapidKeyResponse, error) {
+	resp := &VapidKeyResponse{}
+	return resp, c.do(ctx, http.MethodGet, "/api/vapid", nil, nil, resp)
+}
+
+func (c *Client) Status(ctx context.Context) (*StatusResponse, error) {
+	resp := &StatusResponse{}
+	return resp, c.do(ctx, http.MethodGet, "/api/status", nil, nil, resp)
+}
+
+// ListTopics lists topics starting with prefix, archived filters on the
+// archived state when not nil.
+func (c *Client) ListTopics(ctx context.Context, prefix string, archived *bool, opts *ListOptions) (*TopicsResponse, error) {
+	q := opts.query()
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if archived != nil {
+		q.Set("archived", strconv.FormatBool(*archived))
+	}
+
+	resp := &TopicsResponse{}
+	return resp, c.do(ctx, http.MethodGet, withQuery("/api/topics", q), nil, nil, resp)
+}
+
+// ListSubscriptions lists the subscriptions of a topic without their keys,
+// with the admin key.
+func (c *Client) ListSubscriptions(ctx context.Context, topic string, filter *SubscriptionFilter, opts *ListOptions) (*SubscriptionsResponse, error) {
+	q := opts.query()
+	if filter != nil {
+		if filter.Timezone != "" {
+			q.Set("timezone", filter.Timezone)
+		}
+		if filter.Host != "" {
+			q.Set("host", filter.Host)
+		}
+		if filter.Flagged != nil {
+			q.Set("flagged", strconv.FormatBool(*filter.Flagged))
+		}
+	}
+
+	resp := &SubscriptionsResponse{}
+	return resp, c.do(ctx, http.MethodGet, withQuery(topicPath(topic, "/subscriptions"), q), nil, nil, resp)
+}
+
+// ListNotifications lists pending notifications, with the admin key.
+func (c *Client) ListNotifications(ctx context.Context, filter *NotificationFilter, opts *ListOptions) (*NotificationsResponse, error) {
+	q := opts.query()
+	if filter != nil {
+		if filter.Topic != "" {
+			q.Set("topic", filter.Topic)
+		}
+		if !filter.Before.IsZero() {
+			q.Set("before", filter.Before.Format(time.RFC3339))
+		}
+		if !filter.After.IsZero() {
+			q.Set("after", filter.After.Format(time.RFC3339))
+		}
+	}
+
+	resp := &NotificationsResponse{}
+	return resp, c.do(ctx, http.MethodGet, withQuery("/api/notifications", q), nil, nil, resp)
+}
+
+// DueNotifications lists up to limit pending notifications of all topics in
+// the order they are sent, the server's default when limit is 0, with the
+// admin key.
+func (c *Client) DueNotifications(ctx context.Context, limit int) (*NotificationsResponse, error) {
+	q := url.Values{}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+
+	resp := &NotificationsResponse{}
+	return resp, c.do(ctx, http.MethodGet, withQuery("/api/notifications/due", q), nil, nil, resp)
+}
+
+func (c *Client) Topic(ctx context.Context, topic string) (*TopicResponse, error) {
+	resp := &TopicResponse{}
+	return resp, c.do(ctx, http.MethodGet, topicPath(topic, ""), nil, nil, resp)
+}
+
+func (c *Client) CreateTopic(ctx context.Context, req *TopicRequest) (*TopicResponse, error) {
+	resp := &TopicResponse{}
+	return resp, c.do(ctx, http.MethodPost, "/api/topics", nil, req, resp)
+}
+
+// UpdateTopic replaces the metadata of a topic, registering it if needed.
+func (c *Client) UpdateTopic(ctx context.Context, topic string, req *TopicRequest) (*TopicResponse, error) {
+	resp := &TopicResponse{}
+	return resp, c.do(ctx, http.MethodPut, topicPath(topic, ""), nil, req, resp)
+}
+
+func (c *Client) DeleteTopic(ctx context.Context, topic string) (*Response, error) {
+	resp := &Response{}
+	return resp, c.do(ctx, http.MethodDelete, topicPath(topic, ""), nil, nil, resp)
+}
+
+func (c *Client) Subscribe(ctx context.Context, topic string, req *SubscribeRequest) (*SubscriptionResponse, error) {
+	resp := &SubscriptionResponse{}
+	return resp, c.do(ctx, http.MethodPost, topicPath(topic, "/subscribe"), nil, req, resp)
+}
+
+// Unsubscribe removes the subscription of an endpoint to a topic.
+func (c *Client) Unsubscribe(ctx context.Context, topic string, req *UnsubscribeRequest) (*SubscriptionResponse, error) {
+	resp := &SubscriptionResponse{}
+	return resp, c.do(ctx, http.MethodPost, topicPath(topic, "/unsubscribe"), nil, req, resp)
+}
+
+func (c *Client) Push(ctx context.Context, topic string, req *PushRequest) (*NotificationResponse, error) {
+	header := http.Header{}
+	if req.IdempotencyKey != "" {
+		header.Set("Idempotency-Key", req.IdempotencyKey)
+	}
+
+	resp := &NotificationResponse{}
+	return resp, c.do(ctx, http.MethodPost, topicPath(topic, "/push"), header, req, resp)
+}
+
+// JanitorReport lists the subscriptions the janitor would prune.
+func (c *Client) JanitorReport(ctx context.Context) (*JanitorResponse, error) {
+	resp := &JanitorResponse{}
+	return resp, c.do(ctx, http.MethodGet, "/api/admin/janitor", nil, nil, resp)
+}
+
+// RunJanitor prunes stale subscriptions now.
+func (c *Client) RunJanitor(ctx context.Context) (*JanitorResponse, error) {
+	resp := &JanitorResponse{}
+	return resp, c.do(ctx, http.MethodPost, "/api/admin/janitor", nil, nil, resp)
+}
+
+// Track reports a display, click or close event of a delivered notification,
+// with the tracking token its payload carried.
+func (c *Client) Track(ctx context.Context, token, event string) (*Response, error) {
+	resp := &Response{}
+	path := fmt.Sprintf("/api/track/%s/%s", url.PathEscape(token), url.PathEscape(event))
+	return resp, c.do(ctx, http.MethodPost, path, nil, nil, resp)
+}
+
+func (c *Client) NotificationAnalytics(ctx context.Context, notification string) (*AnalyticsResponse, error) {
+	resp := &AnalyticsResponse{}
+	return resp, c.do(ctx, http.MethodGet, "/api/analytics/notification/"+url.PathEscape(notification), nil, nil, resp)
+}
+
+func (c *Client) TopicAnalytics(ctx context.Context, topic string) (*AnalyticsResponse, error) {
+	resp := &AnalyticsResponse{}
+	return resp, c.do(ctx, http.MethodGet, "/api/analytics/topic/"+url.PathEscape(topic), nil, nil, resp)
+}
+
+// Backup writes a snapshot of the database file to w.
+func (c *Client) Backup(ctx context.Context, w io.Writer) error {
+	return c.do(ctx, http.MethodGet, "/api/admin/backup", nil, nil, w)
+}
+
+// Export writes the VAPID keys, topics, subscriptions and pending
+// notifications to w as JSON lines.
+func (c *Client) Export(ctx context.Context, w io.Writer) error {
+	return c.do(ctx, http.MethodGet, "/api/admin/export", nil, nil, w)
+}
+
+// Import reads an export, merging it with the existing records when merge
+// is set instead of overwriting them.
+func (c *Client) Import(ctx context.Context, r io.Reader, merge bool) (*ImportResponse, error) {
+	q := url.Values{}
+	if merge {
+		q.Set("mode", "merge")
+	}
+
+	resp := &ImportResponse{}
+	return resp, c.do(ctx, http.MethodPost, withQuery("/api/admin/import", q), nil, r, resp)
+}
+
+// AddVapidKeys adds a key pair that imported subscriptions were made with,
+// e.g. that of a previous push vendor.
+func (c *Client) AddVapidKeys(ctx context.Context, keys push.VapidKeys) (*Response, error) {
+	resp := &Response{}
+	return resp, c.do(ctx, http.MethodPost, "/api/admin/vapid", nil, keys, resp)
+}
+
+// ImportSubscriptions bulk imports raw browser subscriptions from r, as JSON
+// lines or CSV.
+func (c *Client) ImportSubscriptions(ctx context.Context, r io.Reader, opts *SubscriptionImportOptions) (*SubscriptionImportResponse, error) {
+	q := url.Values{}
+	if opts != nil {
+		if opts.Format != "" {
+			q.Set("format", opts.Format)
+		}
+		if opts.Topic != "" {
+			q.Set("topic", opts.Topic)
+		}
+		if opts.VapidKey != "" {
+			q.Set("vapidKey", opts.VapidKey)
+		}
+	}
+
+	resp := &SubscriptionImportResponse{}
+	return resp, c.do(ctx, http.MethodPost, withQuery("/api/admin/subscriptions/import", q), nil, r, resp)
+}
+
+// Quarantined lists the stored records that failed to decode.
+func (c *Client) Quarantined(ctx context.Context) (*QuarantineResponse, error) {
+	resp := &QuarantineResponse{}
+	return resp, c.do(ctx, http.MethodGet, "/api/admin/quarantine", nil, nil, resp)
+}
+
+// topicPath escapes the topic, keeping the ".*" of wildcard topics as is.
+func topicPath(topic, suffix string) string {
+	wildcard := ""
+	if parent, ok := strings.CutSuffix(topic, ".*"); ok {
+		topic, wildcard = parent, ".*"
+	}
+	return fmt.Sprintf("/api/topic/%s%s%s", url.PathEscape(topic), wildcard, suffix)
+}
+
+func withQuery(path string, q url.Values) string {
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
+}
+
+// do sends a request with an optional json body and decodes the json response
+// into out, or into an *Error for unsuccessful responses. Readers and writers
+// are streamed as is instead.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body, out interface{}) error {
+	var reqBody io.Reader
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		// streamed as is, e.g. an import
+		reqBody = b
+		contentType = "application/x-ndjson"
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.adminKey != "" {
+		req.Header.Set("X-Admin-Key", c.adminKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{HTTPStatus: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return apiErr
+	}
+
+	switch o := out.(type) {
+	case nil:
+		return nil
+	case io.Writer:
+		_, err := io.Copy(o, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
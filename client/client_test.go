@@ -0,0 +1,96 @@
+package client
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTopicPath(t *testing.T) {
+	tests := []struct {
+		topic, suffix string
+		want          string
+	}{
+		{"sports", "", "/api/topic/sports"},
+		{"sports.football", "/push", "/api/topic/sports.football/push"},
+		{"sports.*", "/subscribe", "/api/topic/sports.*/subscribe"},
+		{"a/b", "", "/api/topic/a%2Fb"},
+		{"a?b.*", "", "/api/topic/a%3Fb.*"},
+	}
+	for _, tt := range tests {
+		if got := topicPath(tt.topic, tt.suffix); got != tt.want {
+			t.Errorf("topicPath(%q, %q) = %q, want %q", tt.topic, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+// the client method of each operation of the spec, empty for those meant for
+// browsers rather than API clients
+var operationMethods = map[string]string{
+	"getOpenAPI":               "",
+	"getStatus":                "Status",
+	"getVapidKey":              "VapidKey",
+	"getJanitorReport":         "JanitorReport",
+	"runJanitor":               "RunJanitor",
+	"getTopic":                 "Topic",
+	"updateTopic":              "UpdateTopic",
+	"deleteTopic":              "DeleteTopic",
+	"subscribe":                "Subscribe",
+	"unsubscribe":              "Unsubscribe",
+	"push":                     "Push",
+	"listTopics":               "ListTopics",
+	"createTopic":              "CreateTopic",
+	"listSubscriptions":        "ListSubscriptions",
+	"listNotifications":        "ListNotifications",
+	"listDueNotifications":     "DueNotifications",
+	"track":                    "Track",
+	"getNotificationAnalytics": "NotificationAnalytics",
+	"getTopicAnalytics":        "TopicAnalytics",
+	"followRedirect":           "",
+	"getBrowserSDK":            "",
+	"getServiceWorkerSDK":      "",
+	"backup":                   "Backup",
+	"export":                   "Export",
+	"import":                   "Import",
+	"addVapidKeys":             "AddVapidKeys",
+	"importSubscriptions":      "ImportSubscriptions",
+	"quarantine":               "Quarantined",
+}
+
+func TestClientCoversSpec(t *testing.T) {
+	data, err := os.ReadFile("../server/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	client := reflect.TypeOf(&Client{})
+	for path, operations := range spec.Paths {
+		for method, raw := range operations {
+			if method == "parameters" {
+				continue
+			}
+			var operation struct {
+				OperationID string `json:"operationId"`
+			}
+			if err := json.Unmarshal(raw, &operation); err != nil {
+				t.Fatal(err)
+			}
+
+			name, ok := operationMethods[operation.OperationID]
+			if !ok {
+				t.Errorf("%s %s: operation %q has no client method", method, path, operation.OperationID)
+				continue
+			}
+			if _, ok := client.MethodByName(name); name != "" && !ok {
+				t.Errorf("%s %s: client method %s of operation %q doesn't exist", method, path, name, operation.OperationID)
+			}
+		}
+	}
+}
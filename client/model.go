@@ -0,0 +1,265 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// requests
+
+// PushSubscription is a PushSubscription as serialized by the browser.
+type PushSubscription struct {
+	webpush.Subscription
+
+	// milliseconds since the epoch
+	ExpirationTime *int64 `json:"expirationTime,omitempty"`
+}
+
+type SubscribeRequest struct {
+	Subscription PushSubscription `json:"subscription"`
+	Timezone     string           `json:"timezone,omitempty"`
+	QuietHours   *push.QuietHours `json:"quietHours,omitempty"`
+}
+
+// UnsubscribeRequest identifies the subscription to remove by its endpoint,
+// along with its auth secret.
+type UnsubscribeRequest struct {
+	Subscription PushSubscription `json:"subscription"`
+}
+
+type TopicRequest struct {
+	// only read when creating a topic
+	ID string `json:"id,omitempty"`
+
+	Name        string             `json:"name,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Owner       string             `json:"owner,omitempty"`
+	Defaults    push.TopicDefaults `json:"defaults"`
+	Replay      push.ReplayOptions `json:"replay"`
+	Archived    bool               `json:"archived,omitempty"`
+}
+
+type PushRequest struct {
+	push.PushPayload
+	push.NotificationOptions
+
+	// RFC 3339 time, a wall clock time with LocalTime
+	Scheduled string `json:"scheduled,omitempty"`
+	LocalTime bool   `json:"localTime,omitempty"`
+
+	// payloads tested against each other, overriding the fields above
+	Variants []Variant `json:"variants,omitempty"`
+
+	// sent as the Idempotency-Key header
+	IdempotencyKey string `json:"-"`
+}
+
+// Variant is a payload tested against the other variants of a notification,
+// fields left out are taken from the notification's payload.
+type Variant struct {
+	push.PushPayload
+
+	ID string `json:"id"`
+	// share of subscriptions relative to the other variants, 1 when nil, 0
+	// leaves the variant out
+	Weight *int `json:"weight,omitempty"`
+}
+
+// ScheduleAt sets the time to send the notification at.
+func (pr *PushRequest) ScheduleAt(t time.Time) {
+	pr.Scheduled = t.Format(time.RFC3339)
+}
+
+// ListOptions pages through a listing, pass the Next of a response as Cursor
+// to get the following page.
+type ListOptions struct {
+	Limit  int
+	Cursor string
+}
+
+func (lo *ListOptions) query() url.Values {
+	q := url.Values{}
+	if lo == nil {
+		return q
+	}
+	if lo.Limit > 0 {
+		q.Set("limit", strconv.Itoa(lo.Limit))
+	}
+	if lo.Cursor != "" {
+		q.Set("cursor", lo.Cursor)
+	}
+	return q
+}
+
+type SubscriptionFilter struct {
+	Timezone string
+	Host     string
+	Flagged  *bool
+}
+
+type NotificationFilter struct {
+	Topic  string
+	Before time.Time
+	After  time.Time
+}
+
+// responses
+
+type Response struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is returned for any response that is not successful.
+type Error struct {
+	Response
+	Code      string       `json:"code"`
+	Details   []FieldError `json:"details,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+
+	HTTPStatus int `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("webpush-api: %d %s: %s", e.HTTPStatus, e.Code, e.Message)
+}
+
+type VapidKeyResponse struct {
+	Response
+	Key string `json:"key"`
+}
+
+type SubscriptionResponse struct {
+	Response
+	ID string `json:"id"`
+}
+
+type NotificationResponse struct {
+	Response
+	ID string `json:"id"`
+}
+
+type TopicResponse struct {
+	Response
+	Topic             push.Topic `json:"topic"`
+	SubscriptionCount int        `json:"subscriptionCount"`
+}
+
+type StatusResponse struct {
+	Response
+	Jobs          int `json:"jobs"`
+	Topics        int `json:"topics"`
+	Notifications int `json:"notifications"`
+	Subscriptions int `json:"subscriptions"`
+}
+
+type TopicSummary struct {
+	push.Topic
+	Subscriptions int `json:"subscriptions"`
+}
+
+type TopicsResponse struct {
+	Response
+	Topics []TopicSummary `json:"topics"`
+	Next   string         `json:"next,omitempty"`
+}
+
+type SubscriptionsResponse struct {
+	Response
+	// listed without their keys
+	Subscriptions []push.Subscription `json:"subscriptions"`
+	Total         int                 `json:"total"`
+	Next          string              `json:"next,omitempty"`
+}
+
+type NotificationsResponse struct {
+	Response
+	Notifications []push.Notification `json:"notifications"`
+	Total         int                 `json:"total"`
+	Next          string              `json:"next,omitempty"`
+}
+
+type StaleSubscription struct {
+	ID       string `json:"id"`
+	Topic    string `json:"topic"`
+	Endpoint string `json:"endpoint"`
+	Reason   string `json:"reason"`
+}
+
+type JanitorResponse struct {
+	Response
+	DryRun        bool                `json:"dryRun"`
+	Subscriptions []StaleSubscription `json:"subscriptions"`
+}
+
+type Funnel struct {
+	Funnel      push.Stats `json:"funnel"`
+	DisplayRate float64    `json:"displayRate"`
+	ClickRate   float64    `json:"clickRate"`
+}
+
+type VariantFunnel struct {
+	ID string `json:"id"`
+	Funnel
+}
+
+type AnalyticsResponse struct {
+	Response
+	Topic        string `json:"topic"`
+	Notification string `json:"notification,omitempty"`
+	Funnel
+	Variants []VariantFunnel `json:"variants,omitempty"`
+}
+
+type ImportError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+type ImportResponse struct {
+	Response
+	Imported map[string]int `json:"imported"`
+	Skipped  map[string]int `json:"skipped"`
+	Errors   []ImportError  `json:"errors"`
+}
+
+type SubscriptionImportOptions struct {
+	// "jsonl" (the default) or "csv"
+	Format string
+	// topic of the lines that don't name one
+	Topic string
+	// public key of a key pair added with AddVapidKeys
+	VapidKey string
+}
+
+type SubscriptionImportResponse struct {
+	Response
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// QuarantinedRecord is a stored record that failed to decode.
+type QuarantinedRecord struct {
+	Key           string    `json:"key"`
+	Value         string    `json:"value"`
+	Error         string    `json:"error"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+type QuarantineResponse struct {
+	Response
+	SchemaVersion int                 `json:"schemaVersion"`
+	Records       []QuarantinedRecord `json:"records"`
+}
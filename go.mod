@@ -10,6 +10,7 @@ require (
 	github.com/go-co-op/gocron v1.23.0
 	github.com/google/uuid v1.3.0
 	github.com/tidwall/buntdb v1.3.0
+	github.com/tidwall/match v1.1.1
 )
 
 require (
@@ -19,7 +20,6 @@ require (
 	github.com/tidwall/btree v1.6.0 // indirect
 	github.com/tidwall/gjson v1.14.4 // indirect
 	github.com/tidwall/grect v0.1.4 // indirect
-	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/rtred v0.1.2 // indirect
 	github.com/tidwall/tinyqueue v0.1.1 // indirect
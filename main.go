@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -13,19 +15,91 @@ import (
 )
 
 func main() {
+	if err := runCLI(os.Args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			log.Println("[ERROR]", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func dbPathFromEnv() string {
+	if path := os.Getenv("DB_PATH"); path != "" {
+		return path
+	}
+	return "store.db"
+}
+
+// masterKeyFromEnv returns the key the secrets in the database are encrypted
+// with, nil when there is none.
+func masterKeyFromEnv() ([]byte, error) {
+	if key := os.Getenv("ENCRYPTION_KEY"); key != "" {
+		return store.ParseMasterKey(key)
+	}
+	if path := os.Getenv("ENCRYPTION_KEY_FILE"); path != "" {
+		return readMasterKey(path)
+	}
+	return nil, nil
+}
+
+func readMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := store.ParseMasterKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// openStore opens the database file, creating it if needed, migrates it to
+// the current schema version, and encrypts its secrets when a master key is
+// set and they aren't yet.
+func openStore(path string) (*store.Store, error) {
+	masterKey, err := masterKeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	s, err := store.Open(path, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := s.Migrate()
+	for _, migration := range migrations {
+		log.Printf("[INFO] Migrated store to schema version %d: %s", migration.Version, migration.Description)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if masterKey != nil && !s.Encrypted() {
+		count, err := s.Rekey(masterKey)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		log.Printf("[INFO] Encrypted the secrets of %d records", count)
+	}
+	return s, nil
+}
+
+func serve(dbPath string) error {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	store, err := store.NewStore()
+	store, err := openStore(dbPath)
 	if err != nil {
 		log.Fatal("[ERROR] Failed to initialize store: ", err)
 	}
-
-	port := "8080"
-	if p := os.Getenv("PORT"); p != "" {
-		port = p
+	if count, err := store.CountQuarantined(); err == nil && count > 0 {
+		log.Printf("[INFO] %d records that failed to decode are quarantined", count)
 	}
-	s := server.NewServer(":"+port, store)
+
+	s := server.NewServer(server.ConfigFromEnv(), store)
 
 	go func() {
 		log.Println("[INFO] Starting API server...")
@@ -39,4 +113,5 @@ func main() {
 	defer cancel()
 	s.Shutdown(ctx)
 	log.Println("[INFO] Server stopped")
+	return nil
 }
@@ -0,0 +1,64 @@
+package push
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DefaultPushHosts are the hosts of the major browser push services.
+var DefaultPushHosts = []string{
+	"fcm.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"*.notify.windows.com",
+	"*.push.apple.com",
+}
+
+// CheckEndpoint verifies that a subscription endpoint is an https URL on one
+// of the allowed hosts. A "*." prefix matches any subdomain, and "*" any host
+// but private, loopback, link-local and unspecified IP addresses, which are
+// only allowed when listed as they are.
+func CheckEndpoint(endpoint string, allowedHosts []string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("endpoint must be an https url")
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("endpoint has no host")
+	}
+
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	internal := ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified())
+
+	for _, allowed := range allowedHosts {
+		if allowed == host {
+			return nil
+		}
+		if internal {
+			continue
+		}
+		if allowed == "*" {
+			return nil
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("endpoint host %q is not a known push service", host)
+}
+
+func endpointHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	return u.Host
+}
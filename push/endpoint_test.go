@@ -0,0 +1,50 @@
+package push
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		allowed  []string
+		err      string
+	}{
+		{"known service", "https://fcm.googleapis.com/fcm/send/x", DefaultPushHosts, ""},
+		{"subdomain", "https://wns2-par02p.notify.windows.com/w/?token=x", DefaultPushHosts, ""},
+		{"host case", "https://FCM.googleapis.com/fcm/send/x", DefaultPushHosts, ""},
+		{"port", "https://push.example.com:8443/x", []string{"push.example.com"}, ""},
+		{"http", "http://fcm.googleapis.com/fcm/send/x", DefaultPushHosts, "endpoint must be an https url"},
+		{"no scheme", "fcm.googleapis.com/fcm/send/x", DefaultPushHosts, "endpoint must be an https url"},
+		{"invalid", "https://%zz", DefaultPushHosts, "invalid endpoint"},
+		{"no host", "https:///x", DefaultPushHosts, "endpoint has no host"},
+		{"unknown host", "https://evil.example.com/x", DefaultPushHosts, "endpoint host"},
+		{"suffix without dot", "https://evilpush.apple.com/x", DefaultPushHosts, "endpoint host"},
+		{"wildcard parent itself", "https://push.apple.com/x", DefaultPushHosts, "endpoint host"},
+		{"any host", "https://evil.example.com/x", []string{"*"}, ""},
+		{"public ip with any host", "https://203.0.113.7/x", []string{"*"}, ""},
+		{"private ip", "https://10.0.0.1/x", []string{"*"}, "endpoint host"},
+		{"private ip 192.168", "https://192.168.1.1/x", []string{"*"}, "endpoint host"},
+		{"loopback", "https://127.0.0.1:8443/x", []string{"*"}, "endpoint host"},
+		{"loopback ipv6", "https://[::1]/x", []string{"*"}, "endpoint host"},
+		{"link-local", "https://169.254.169.254/latest", []string{"*"}, "endpoint host"},
+		{"unspecified", "https://0.0.0.0/x", []string{"*"}, "endpoint host"},
+		{"unique local ipv6", "https://[fd00::1]/x", []string{"*"}, "endpoint host"},
+		{"listed private ip", "https://10.0.0.1/x", []string{"*", "10.0.0.1"}, ""},
+		{"listed loopback", "https://127.0.0.1:8443/x", []string{"127.0.0.1"}, ""},
+	}
+	for _, tt := range tests {
+		err := CheckEndpoint(tt.endpoint, tt.allowed)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: got %v, want allowed", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package push
+
+import (
+	"fmt"
+	"time"
+
+	// bundle the timezone database so subscriber timezones resolve everywhere
+	_ "time/tzdata"
+)
+
+const clockLayout = "15:04"
+
+// LoadLocation resolves an IANA timezone name, falling back to UTC.
+func LoadLocation(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// WallTime places the wall clock time of t in the given location.
+func WallTime(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+func (q *QuietHours) Validate() error {
+	start, err := time.Parse(clockLayout, q.Start)
+	if err != nil {
+		return fmt.Errorf("invalid quiet hours start %q", q.Start)
+	}
+	end, err := time.Parse(clockLayout, q.End)
+	if err != nil {
+		return fmt.Errorf("invalid quiet hours end %q", q.End)
+	}
+	if start.Equal(end) {
+		return fmt.Errorf("quiet hours start and end must differ")
+	}
+	return nil
+}
+
+// Location returns the subscription's timezone, UTC if none was given.
+func (s *Subscription) Location() *time.Location {
+	return LoadLocation(s.Timezone)
+}
+
+// QuietUntil reports whether t falls within the subscription's quiet hours,
+// and if so when they end.
+func (s *Subscription) QuietUntil(t time.Time) (time.Time, bool) {
+	if s.QuietHours == nil {
+		return time.Time{}, false
+	}
+
+	start, err := time.Parse(clockLayout, s.QuietHours.Start)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := time.Parse(clockLayout, s.QuietHours.End)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	local := t.In(s.Location())
+	now := local.Hour()*60 + local.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+
+	until := time.Date(local.Year(), local.Month(), local.Day(), end.Hour(), end.Minute(), 0, 0, local.Location())
+
+	if from < to {
+		return until, now >= from && now < to
+	}
+
+	// the window wraps past midnight
+	if now >= from {
+		return until.AddDate(0, 0, 1), true
+	}
+	return until, now < to
+}
+
+// Targets reports whether the subscription should receive this notification.
+func (n *Notification) Targets(s *Subscription) bool {
+	if n.SubscriptionID != "" {
+		return n.SubscriptionID == s.ID
+	}
+	if n.LocalTime && n.Timezone != "" {
+		return s.Location().String() == n.Timezone
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package push
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWallTime(t *testing.T) {
+	t9 := time.Date(2026, 3, 8, 9, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		timezone string
+		want     string
+	}{
+		{"", "2026-03-08T09:30:00Z"},
+		{"Europe/Paris", "2026-03-08T08:30:00Z"},
+		{"America/New_York", "2026-03-08T13:30:00Z"},
+		{"Asia/Kolkata", "2026-03-08T04:00:00Z"},
+		{"Not/AZone", "2026-03-08T09:30:00Z"},
+	}
+	for _, tt := range tests {
+		got := WallTime(t9, LoadLocation(tt.timezone)).UTC().Format(time.RFC3339)
+		if got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.timezone, got, tt.want)
+		}
+	}
+}
+
+func TestQuietHoursValidate(t *testing.T) {
+	tests := []struct {
+		start, end string
+		valid      bool
+	}{
+		{"22:00", "07:00", true},
+		{"13:00", "14:30", true},
+		{"22:00", "22:00", false},
+		{"25:00", "07:00", false},
+		{"22:00", "7am", false},
+	}
+	for _, tt := range tests {
+		err := (&QuietHours{Start: tt.start, End: tt.end}).Validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s-%s: got %v, want valid %v", tt.start, tt.end, err, tt.valid)
+		}
+	}
+}
+
+func TestQuietUntil(t *testing.T) {
+	paris := LoadLocation("Europe/Paris")
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 6, day, hour, minute, 0, 0, paris)
+	}
+
+	tests := []struct {
+		name      string
+		quiet     *QuietHours
+		t         time.Time
+		wantQuiet bool
+		want      time.Time
+	}{
+		{name: "no quiet hours", t: at(10, 23, 0)},
+		{name: "before the window", quiet: &QuietHours{"13:00", "14:00"}, t: at(10, 12, 59)},
+		{name: "within the window", quiet: &QuietHours{"13:00", "14:00"}, t: at(10, 13, 0), wantQuiet: true, want: at(10, 14, 0)},
+		{name: "at the end", quiet: &QuietHours{"13:00", "14:00"}, t: at(10, 14, 0)},
+		{name: "before midnight", quiet: &QuietHours{"22:00", "07:00"}, t: at(10, 23, 30), wantQuiet: true, want: at(11, 7, 0)},
+		{name: "after midnight", quiet: &QuietHours{"22:00", "07:00"}, t: at(11, 6, 59), wantQuiet: true, want: at(11, 7, 0)},
+		{name: "outside a wrapping window", quiet: &QuietHours{"22:00", "07:00"}, t: at(10, 12, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Subscription{Timezone: "Europe/Paris", QuietHours: tt.quiet}
+			// the time is given in UTC, quiet hours apply in the subscriber's timezone
+			until, quiet := s.QuietUntil(tt.t.UTC())
+			if quiet != tt.wantQuiet {
+				t.Fatalf("got quiet %v, want %v", quiet, tt.wantQuiet)
+			}
+			if quiet && !until.Equal(tt.want) {
+				t.Errorf("got until %s, want %s", until, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargets(t *testing.T) {
+	paris := Subscription{ID: "s1", Timezone: "Europe/Paris"}
+	utc := Subscription{ID: "s2"}
+
+	tests := []struct {
+		name         string
+		notification Notification
+		want         []bool
+	}{
+		{"everyone", Notification{}, []bool{true, true}},
+		{"one subscription", Notification{SubscriptionID: "s2"}, []bool{false, true}},
+		{"one timezone", Notification{LocalTime: true, Timezone: "Europe/Paris"}, []bool{true, false}},
+		{"utc", Notification{LocalTime: true, Timezone: "UTC"}, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		for i, s := range []Subscription{paris, utc} {
+			if got := tt.notification.Targets(&s); got != tt.want[i] {
+				t.Errorf("%s: subscription %s got %v, want %v", tt.name, s.ID, got, tt.want[i])
+			}
+		}
+	}
+}
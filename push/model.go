@@ -1,6 +1,7 @@
 package push
 
 import (
+	"sync"
 	"time"
 
 	webpush "github.com/SherClockHolmes/webpush-go"
@@ -8,6 +9,12 @@ import (
 
 type WebPush struct {
 	VapidKeys
+	// guards VapidKeys and keyring, which can change while sending
+	keysMu sync.RWMutex
+	// other key pairs subscriptions were made with, by public key
+	keyring map[string]VapidKeys
+
+	throttle *throttle
 }
 
 type VapidKeys struct {
@@ -30,13 +37,68 @@ type PushPayload struct {
 	Body     string `json:"body"`
 	Icon     string `json:"icon,omitempty"`
 	Redirect string `json:"redirect,omitempty"`
+
+	// identify the notification when the service worker reports events
+	ID      string `json:"id,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	Variant string `json:"variant,omitempty"`
+	// signed token of the delivery, the service worker reports events with
+	Track string `json:"track,omitempty"`
+}
+
+// QuietHours is a daily window in the subscriber's local time during which
+// notifications are held back. Start and End are "15:04" clock times, and a
+// window that ends before it starts wraps past midnight.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// TopicDefaults fill in the options a notification to the topic leaves out.
+type TopicDefaults struct {
+	TTL     int             `json:"ttl,omitempty"`
+	Urgency webpush.Urgency `json:"urgency,omitempty"`
+	Icon    string          `json:"icon,omitempty"`
+}
+
+// ReplayOptions has new subscribers receive the latest notifications sent to
+// the topic, up to Count of them sent within the last MaxAge seconds.
+type ReplayOptions struct {
+	Count  int `json:"count,omitempty"`
+	MaxAge int `json:"maxAge,omitempty"`
+}
+
+type Topic struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Owner       string        `json:"owner,omitempty"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	Defaults    TopicDefaults `json:"defaults"`
+	Replay      ReplayOptions `json:"replay"`
+	// archived topics take no new subscriptions or notifications
+	Archived bool `json:"archived,omitempty"`
 }
 
 type Subscription struct {
 	webpush.Subscription
 
-	ID    string `json:"id"`
-	Topic string `json:"topic"`
+	ID         string      `json:"id"`
+	Topic      string      `json:"topic"`
+	Timezone   string      `json:"timezone,omitempty"`
+	QuietHours *QuietHours `json:"quietHours,omitempty"`
+	// the verification push at subscribe time hard failed
+	Flagged bool `json:"flagged,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	// last time the browser subscribed with this endpoint
+	RefreshedAt time.Time  `json:"refreshedAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	// consecutive failed sends
+	Failures int `json:"failures,omitempty"`
+	// public VAPID key the subscription was made with, when not the server's,
+	// e.g. one imported from another push vendor
+	VapidKey string `json:"vapidKey,omitempty"`
 }
 
 type NotificationOptions struct {
@@ -50,4 +112,31 @@ type Notification struct {
 	Time    time.Time           `json:"time" binding:"required"`
 	Payload PushPayload         `json:"payload" binding:"required"`
 	Options NotificationOptions `json:"options"`
+
+	// when set, Time is a wall clock time delivered in each subscriber's timezone
+	LocalTime bool `json:"localTime,omitempty"`
+	// the timezone batch of a local time notification
+	Timezone string `json:"timezone,omitempty"`
+	// restricts delivery to a single subscription, e.g. after quiet hours
+	SubscriptionID string `json:"subscriptionId,omitempty"`
+	// the store key of that subscription, which may be under a wildcard
+	// parent topic, so it is read without iterating the topic
+	SubscriptionKey string `json:"subscriptionKey,omitempty"`
+	// payloads sent instead of Payload, split between subscriptions by weight
+	Variants []Variant `json:"variants,omitempty"`
 }
+
+// Event is a step of a notification's funnel, from delivery to a click.
+type Event string
+
+const (
+	EventDelivered Event = "delivered"
+	EventDisplayed Event = "displayed"
+	EventClicked   Event = "clicked"
+	EventClosed    Event = "closed"
+)
+
+var Events = []Event{EventDelivered, EventDisplayed, EventClicked, EventClosed}
+
+// Stats counts the events of one notification or of a whole topic.
+type Stats map[Event]int
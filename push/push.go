@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"log"
+	"strconv"
 	"time"
 
 	webpush "github.com/SherClockHolmes/webpush-go"
@@ -19,14 +20,52 @@ func GenerateVAPIDKeys() VapidKeys {
 }
 
 func NewWebPush(vapidPublicKey, vapidPrivateKey string) (wp *WebPush) {
-	wp = &WebPush{VapidKeys{vapidPublicKey, vapidPrivateKey}}
+	wp = &WebPush{
+		VapidKeys: VapidKeys{vapidPublicKey, vapidPrivateKey},
+		throttle:  newThrottle(0),
+		keyring:   make(map[string]VapidKeys),
+	}
 	return
 }
 
+// SetHostRate caps the sends per second to each push service host, 0 removes the cap.
+func (w *WebPush) SetHostRate(perSecond int) {
+	w.throttle = newThrottle(perSecond)
+}
+
 func (w *WebPush) GetVapidKeys() VapidKeys {
+	w.keysMu.RLock()
+	defer w.keysMu.RUnlock()
 	return w.VapidKeys
 }
 
+// AddVapidKeys lets subscriptions made with another key pair, e.g. that of a
+// previous push vendor, be sent to.
+func (w *WebPush) AddVapidKeys(keys VapidKeys) {
+	w.keysMu.Lock()
+	defer w.keysMu.Unlock()
+	w.keyring[keys.VAPIDPublicKey] = keys
+}
+
+// KeysFor returns the key pair of a subscription's public key, reporting
+// whether it is known. An empty key is the server's own.
+func (w *WebPush) KeysFor(publicKey string) (VapidKeys, bool) {
+	w.keysMu.RLock()
+	defer w.keysMu.RUnlock()
+	if publicKey == "" || publicKey == w.VAPIDPublicKey {
+		return w.VapidKeys, true
+	}
+	keys, ok := w.keyring[publicKey]
+	return keys, ok
+}
+
+// SetVapidKeys replaces the keys notifications are sent with.
+func (w *WebPush) SetVapidKeys(keys VapidKeys) {
+	w.keysMu.Lock()
+	defer w.keysMu.Unlock()
+	w.VapidKeys = keys
+}
+
 func (w *WebPush) Send(subscription *webpush.Subscription, payload *PushPayload, options *webpush.Options) PushStatus {
 	p, err := json.Marshal(payload)
 	if err != nil {
@@ -34,16 +73,36 @@ func (w *WebPush) Send(subscription *webpush.Subscription, payload *PushPayload,
 		return PushStatusHardFail
 	}
 
+	return w.send(subscription, p, options)
+}
+
+// Verify sends a push to check that the push service accepts the
+// subscription. Browsers require every push to show a notification, so it
+// carries a title service workers show as a confirmation of the subscription.
+func (w *WebPush) Verify(subscription *webpush.Subscription, title string) PushStatus {
+	p, _ := json.Marshal(map[string]string{"type": "verify", "title": title})
+	return w.send(subscription, p, &webpush.Options{TTL: 0, Urgency: webpush.UrgencyVeryLow})
+}
+
+func (w *WebPush) send(subscription *webpush.Subscription, p []byte, options *webpush.Options) PushStatus {
 	// combine options
 	if options == nil {
 		options = &webpush.Options{}
 	}
+	options.Topic = topicHeader(options.Topic)
 	options.Subscriber = "mail@thedestruc7i0n.ca"
-	options.VAPIDPublicKey = w.VAPIDPublicKey
-	options.VAPIDPrivateKey = w.VAPIDPrivateKey
+	// subscriptions made with other keys come with theirs
+	if options.VAPIDPrivateKey == "" {
+		keys := w.GetVapidKeys()
+		options.VAPIDPublicKey = keys.VAPIDPublicKey
+		options.VAPIDPrivateKey = keys.VAPIDPrivateKey
+	}
 
 	// log.Printf("[INFO] Sending push with options: %+v", options)
 
+	host := endpointHost(subscription.Endpoint)
+	w.throttle.wait(host)
+
 	startedAt := time.Now()
 	resp, err := webpush.SendNotification(p, subscription, options)
 
@@ -64,6 +123,10 @@ func (w *WebPush) Send(subscription *webpush.Subscription, payload *PushPayload,
 		return PushStatusSuccess
 	case 429:
 		log.Println("[INFO] Push rejected by push service (rate limit)", body)
+		// back off the host for as long as the push service asks
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			w.throttle.pause(host, time.Duration(seconds)*time.Second)
+		}
 		return PushStatusTempFail
 	case 400, 404, 405, 413, 500, 501:
 		// Bad Request, Not Found, Method Not Allowed, Payload Too Large, Internal Server Error, Not Implemented
@@ -78,3 +141,18 @@ func (w *WebPush) Send(subscription *webpush.Subscription, payload *PushPayload,
 
 	return PushStatusHardFail
 }
+
+// topicHeader turns a topic into a valid Topic header, which push services
+// limit to 32 characters of the url safe base64 alphabet.
+func topicHeader(topic string) string {
+	header := []byte(topic)
+	for i, c := range header {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			header[i] = '_'
+		}
+	}
+	if len(header) > 32 {
+		header = header[:32]
+	}
+	return string(header)
+}
@@ -0,0 +1,48 @@
+package push
+
+import (
+	"sync"
+	"time"
+)
+
+// throttle paces outgoing sends so that no single push service host receives
+// more than a set number of requests per second.
+type throttle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+}
+
+func newThrottle(perSecond int) *throttle {
+	t := &throttle{next: make(map[string]time.Time)}
+	if perSecond > 0 {
+		t.interval = time.Second / time.Duration(perSecond)
+	}
+	return t
+}
+
+// wait blocks until a request to the host may be sent.
+func (t *throttle) wait(host string) {
+	t.mu.Lock()
+	now := time.Now()
+	at := t.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	t.next[host] = at.Add(t.interval)
+	t.mu.Unlock()
+
+	time.Sleep(time.Until(at))
+}
+
+// pause holds back all requests to the host for the given duration, used
+// when the push service asks us to slow down.
+func (t *throttle) pause(host string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	at := time.Now().Add(d)
+	if t.next[host].Before(at) {
+		t.next[host] = at
+	}
+}
@@ -0,0 +1,66 @@
+package push
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// ValidateKeys checks that the subscription keys decode, that p256dh is a
+// point on the P-256 curve and that auth is a 16 byte secret.
+func ValidateKeys(subscription *webpush.Subscription) error {
+	p256dh, err := decodeKey(subscription.Keys.P256dh)
+	if err != nil {
+		return fmt.Errorf("invalid p256dh key encoding")
+	}
+	if _, err := ecdh.P256().NewPublicKey(p256dh); err != nil {
+		return fmt.Errorf("invalid p256dh key: %v", err)
+	}
+
+	auth, err := decodeKey(subscription.Keys.Auth)
+	if err != nil {
+		return fmt.Errorf("invalid auth secret encoding")
+	}
+	if len(auth) != 16 {
+		return fmt.Errorf("invalid auth secret length %d", len(auth))
+	}
+
+	return nil
+}
+
+// ValidateVapidKeys checks that the private key is a P-256 key and that the
+// public key belongs to it.
+func ValidateVapidKeys(keys VapidKeys) error {
+	private, err := decodeKey(keys.VAPIDPrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key encoding")
+	}
+	privateKey, err := ecdh.P256().NewPrivateKey(private)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+
+	public, err := decodeKey(keys.VAPIDPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key encoding")
+	}
+	if !bytes.Equal(privateKey.PublicKey().Bytes(), public) {
+		return fmt.Errorf("public key does not match the private key")
+	}
+
+	return nil
+}
+
+// decodeKey decodes a base64 key in either alphabet, with or without padding,
+// matching what webpush accepts.
+func decodeKey(key string) ([]byte, error) {
+	key = strings.TrimRight(key, "=")
+	if b, err := base64.RawURLEncoding.DecodeString(key); err == nil {
+		return b, nil
+	}
+	return base64.RawStdEncoding.DecodeString(key)
+}
@@ -0,0 +1,82 @@
+package push
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+func TestValidateKeys(t *testing.T) {
+	const (
+		p256dh = "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM"
+		auth   = "tBHItJI5svbpez7KI4CCXg"
+	)
+	raw, _ := base64.RawURLEncoding.DecodeString(p256dh)
+	encode := base64.RawURLEncoding.EncodeToString
+
+	// an uncompressed point whose coordinates aren't on the curve
+	offCurve := append([]byte{0x04}, bytes.Repeat([]byte{0x01}, 64)...)
+
+	tests := []struct {
+		name   string
+		p256dh string
+		auth   string
+		err    string
+	}{
+		{"valid", p256dh, auth, ""},
+		{"standard alphabet with padding", base64.StdEncoding.EncodeToString(raw), base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")), ""},
+		{"p256dh not base64", "not base64!", auth, "invalid p256dh key encoding"},
+		{"p256dh too short", encode(raw[:33]), auth, "invalid p256dh key"},
+		{"p256dh too long", encode(append(raw, 0)), auth, "invalid p256dh key"},
+		{"p256dh compressed", encode(append([]byte{0x02}, raw[1:33]...)), auth, "invalid p256dh key"},
+		{"p256dh off the curve", encode(offCurve), auth, "invalid p256dh key"},
+		{"p256dh empty", "", auth, "invalid p256dh key"},
+		{"auth not base64", p256dh, "not base64!", "invalid auth secret encoding"},
+		{"auth too short", p256dh, encode(make([]byte, 15)), "invalid auth secret length 15"},
+		{"auth too long", p256dh, encode(make([]byte, 32)), "invalid auth secret length 32"},
+		{"auth empty", p256dh, "", "invalid auth secret length 0"},
+	}
+	for _, tt := range tests {
+		err := ValidateKeys(&webpush.Subscription{Keys: webpush.Keys{P256dh: tt.p256dh, Auth: tt.auth}})
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: got %v, want valid", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestValidateVapidKeys(t *testing.T) {
+	keys := GenerateVAPIDKeys()
+	other := GenerateVAPIDKeys()
+
+	tests := []struct {
+		name string
+		keys VapidKeys
+		err  string
+	}{
+		{"valid", keys, ""},
+		{"mismatched", VapidKeys{VAPIDPublicKey: other.VAPIDPublicKey, VAPIDPrivateKey: keys.VAPIDPrivateKey}, "public key does not match"},
+		{"private key not base64", VapidKeys{VAPIDPublicKey: keys.VAPIDPublicKey, VAPIDPrivateKey: "not base64!"}, "invalid private key encoding"},
+		{"private key too short", VapidKeys{VAPIDPublicKey: keys.VAPIDPublicKey, VAPIDPrivateKey: "AAAA"}, "invalid private key"},
+	}
+	for _, tt := range tests {
+		err := ValidateVapidKeys(tt.keys)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: got %v, want valid", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
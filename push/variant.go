@@ -0,0 +1,47 @@
+package push
+
+import (
+	"hash/fnv"
+)
+
+// Variant is one of several payloads of a notification tested against each
+// other, subscriptions are split between them by weight.
+type Variant struct {
+	ID     string `json:"id"`
+	Weight int    `json:"weight"`
+	PushPayload
+}
+
+// Variant picks the variant a subscription receives. The choice only depends
+// on the notification and subscription, so deferred and replayed deliveries
+// agree with the first one. It is nil for notifications without variants.
+func (n *Notification) Variant(subscriptionID string) *Variant {
+	total := 0
+	for _, variant := range n.Variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(n.ID + ":" + subscriptionID))
+	pick := int(h.Sum32() % uint32(total))
+
+	for i := range n.Variants {
+		pick -= n.Variants[i].Weight
+		if pick < 0 {
+			return &n.Variants[i]
+		}
+	}
+	return nil
+}
+
+// VariantIDs lists the IDs of the notification's variants.
+func (n *Notification) VariantIDs() []string {
+	ids := make([]string, 0, len(n.Variants))
+	for _, variant := range n.Variants {
+		ids = append(ids, variant.ID)
+	}
+	return ids
+}
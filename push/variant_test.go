@@ -0,0 +1,58 @@
+package push
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestNotificationVariant(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+	}{
+		{"even", []int{1, 1}},
+		{"weighted", []int{1, 3}},
+		{"left out", []int{0, 1, 1}},
+		{"three ways", []int{2, 1, 1}},
+	}
+	const subscriptions = 20000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := Notification{ID: "n1"}
+			total := 0
+			for i, weight := range tt.weights {
+				n.Variants = append(n.Variants, Variant{ID: fmt.Sprint(i), Weight: weight})
+				total += weight
+			}
+
+			counts := make(map[string]int)
+			for i := 0; i < subscriptions; i++ {
+				id := fmt.Sprintf("sub-%d", i)
+				variant := n.Variant(id)
+				if variant == nil {
+					t.Fatalf("%s got no variant", id)
+				}
+				if again := n.Variant(id); again.ID != variant.ID {
+					t.Fatalf("%s got variant %s, then %s", id, variant.ID, again.ID)
+				}
+				counts[variant.ID]++
+			}
+
+			for i, weight := range tt.weights {
+				want := float64(subscriptions*weight) / float64(total)
+				got := float64(counts[fmt.Sprint(i)])
+				if weight == 0 && got != 0 {
+					t.Errorf("variant %d weighed 0 got %v subscriptions", i, got)
+				}
+				if math.Abs(got-want) > 0.05*subscriptions {
+					t.Errorf("variant %d: got %v subscriptions, want about %v", i, got, want)
+				}
+			}
+		})
+	}
+
+	if v := (&Notification{ID: "n1"}).Variant("s1"); v != nil {
+		t.Errorf("notification without variants got variant %s", v.ID)
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// requireAdmin only lets requests with the configured X-Admin-Key through.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AdminKey == "" {
+			render.Render(w, r, errNotFound("admin routes are disabled"))
+			return
+		}
+
+		key := r.Header.Get("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.config.AdminKey)) != 1 {
+			render.Render(w, r, errUnauthorized("invalid admin key"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAPIKey only lets requests with one of the configured X-API-Key
+// through, and every request when none are configured.
+func (s *Server) requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.config.APIKeys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Header.Get("X-API-Key")
+		valid := 0
+		for _, apiKey := range s.config.APIKeys {
+			valid |= subtle.ConstantTimeCompare([]byte(key), []byte(apiKey))
+		}
+		if key == "" || valid != 1 {
+			render.Render(w, r, errUnauthorized("invalid api key"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// backup streams a consistent snapshot of the database file.
+func (s *Server) backup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="store-`+time.Now().UTC().Format("20060102T150405Z")+`.db"`)
+
+	// the status is sent by now, a failure can only cut the snapshot short
+	if err := s.store.Backup(w); err != nil {
+		log.Printf("[ERROR] Failed to write backup: %v", err)
+	}
+}
+
+// export streams the VAPID keys, topics, subscriptions and pending
+// notifications as JSON lines.
+func (s *Server) export(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	if err := s.store.Export(w); err != nil {
+		log.Printf("[ERROR] Failed to write export: %v", err)
+	}
+}
+
+// importRecords reads an export, then sends with imported VAPID keys and
+// schedules the imported notifications.
+func (s *Server) importRecords(w http.ResponseWriter, r *http.Request) {
+	merge := false
+	switch r.URL.Query().Get("mode") {
+	case "", "restore":
+	case "merge":
+		merge = true
+	default:
+		render.Render(w, r, errBadRequest("mode must be restore or merge"))
+		return
+	}
+
+	result, err := s.store.Import(r.Body, merge)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to import", err))
+		return
+	}
+
+	if result.VapidKeys != nil {
+		s.push.SetVapidKeys(*result.VapidKeys)
+	}
+	for _, keys := range result.VapidKeyPairs {
+		s.push.AddVapidKeys(keys)
+	}
+	for i := range result.Notifications {
+		s.notifs <- &result.Notifications[i]
+	}
+
+	render.JSON(w, r, newImportResponse(result))
+}
+
+// quarantine lists the stored records that failed to decode.
+func (s *Server) quarantine(w http.ResponseWriter, r *http.Request) {
+	version, err := s.store.SchemaVersion()
+	if err != nil {
+		render.Render(w, r, errInternal("failed to get schema version", err))
+		return
+	}
+
+	records, err := s.store.GetQuarantined()
+	if err != nil {
+		render.Render(w, r, errInternal("failed to get quarantined records", err))
+		return
+	}
+
+	render.JSON(w, r, newQuarantineResponse(version, records))
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+func TestJanitorRequiresAdmin(t *testing.T) {
+	disabled := newTestServer(t, Config{})
+	for _, method := range []string{"GET", "POST"} {
+		if w := serve(t, disabled, method, "/api/admin/janitor", nil, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s without ADMIN_KEY: got status %d, want 404", method, w.Code)
+		}
+	}
+
+	s := newTestServer(t, Config{AdminKey: "secret"})
+	tests := []struct {
+		method string
+		key    string
+		status int
+	}{
+		{"GET", "", http.StatusUnauthorized},
+		{"POST", "wrong", http.StatusUnauthorized},
+		{"GET", "secret", http.StatusOK},
+		{"POST", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.key != "" {
+			header.Set("X-Admin-Key", tt.key)
+		}
+		if w := serve(t, s, tt.method, "/api/admin/janitor", header, nil, nil); w.Code != tt.status {
+			t.Errorf("%s with key %q: got status %d, want %d", tt.method, tt.key, w.Code, tt.status)
+		}
+	}
+
+	if w := serve(t, s, "GET", "/api/janitor", nil, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("old route: got status %d, want 404", w.Code)
+	}
+}
+
+func TestImportModes(t *testing.T) {
+	src := newTestServer(t, Config{AdminKey: "secret"})
+	ps := newPushService(t)
+	if err := src.store.AddSubscriptions([]push.Subscription{ps.subscription("news", "s1", ""), ps.subscription("sports", "s2", "")}); err != nil {
+		t.Fatal(err)
+	}
+	admin := http.Header{"X-Admin-Key": {"secret"}}
+	exported := serve(t, src, http.MethodGet, "/api/admin/export", admin, nil, nil).Body.String()
+
+	tests := []struct {
+		mode     string
+		status   int
+		imported int
+		skipped  int
+	}{
+		{"bogus", http.StatusBadRequest, 0, 0},
+		{"", http.StatusOK, 2, 0},
+		{"restore", http.StatusOK, 2, 0},
+		{"merge", http.StatusOK, 0, 2},
+	}
+
+	dst := newTestServer(t, Config{AdminKey: "secret"})
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/import?mode="+tt.mode, strings.NewReader(exported))
+		req.Header.Set("X-Admin-Key", "secret")
+		w := httptest.NewRecorder()
+		dst.server.Handler.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Fatalf("mode %q: got status %d, want %d", tt.mode, w.Code, tt.status)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		var resp struct {
+			Imported map[string]int `json:"imported"`
+			Skipped  map[string]int `json:"skipped"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Imported["subscription"] != tt.imported || resp.Skipped["subscription"] != tt.skipped {
+			t.Errorf("mode %q: got imported %v, skipped %v", tt.mode, resp.Imported, resp.Skipped)
+		}
+	}
+	if count, _ := dst.store.CountSubscriptions("*"); count != 2 {
+		t.Errorf("got %d subscriptions, want 2", count)
+	}
+}
@@ -1,9 +1,15 @@
 package server
 
 import (
-	"context"
-	"fmt"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/destruc7i0n/webpush-api/push"
@@ -23,29 +29,67 @@ func (s *Server) newRouter() *chi.Mux {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(s.limitBody)
 
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Origin", "Content-Length", "Content-Type"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Origin", "Content-Length", "Content-Type", "X-API-Key", "X-Admin-Key", "Idempotency-Key"},
+		ExposedHeaders:   []string{"Link", "Retry-After", "Idempotent-Replayed"},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		render.Render(w, r, errNotFound("route not found"))
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		render.Render(w, r, newErrorResponse(http.StatusMethodNotAllowed, ErrorCodeMethod, "method not allowed"))
+	})
+
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, newSuccessResponse("hello world"))
 	})
 
+	r.Get("/r/{token}", s.redirect)
+
+	r.Route("/sdk", func(r chi.Router) {
+		r.Get("/webpush.js", s.serveSDK("webpush.js"))
+		r.Get("/sw.js", s.serveSDK("sw.js"))
+	})
+
 	r.Route("/api", func(r chi.Router) {
+		r.Get("/openapi.json", s.getOpenAPI)
 		r.Get("/status", s.status)
 		r.Get("/vapid", s.getVapidKey)
+		r.Get("/topics", s.listTopics)
+		r.With(s.requireAdmin).Get("/notifications", s.listNotifications)
+		r.With(s.requireAdmin).Get("/notifications/due", s.listDueNotifications)
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(s.requireAdmin)
+			r.Get("/backup", s.backup)
+			r.Get("/export", s.export)
+			r.Post("/import", s.importRecords)
+			r.Post("/vapid", s.addVapidKeys)
+			r.Post("/subscriptions/import", s.importSubscriptions)
+			r.Get("/quarantine", s.quarantine)
+			r.Get("/janitor", s.janitorReport)
+			r.Post("/janitor", s.runJanitor)
+		})
 
-		r.Route("/topic/{id:[a-z0-9_-]+}", func(r chi.Router) {
-			r.With(s.topicCtx).Get("/", s.getTopic)
-			r.With(s.topicCtx).Post("/subscribe", s.subscribe)
-			r.Delete("/", s.deleteTopic)
-			r.Post("/push", s.sendNotification)
+		r.Post("/track/{token}/{event}", s.track)
+		r.Get("/analytics/notification/{nid}", s.notificationAnalytics)
+		r.Get("/analytics/topic/{id:"+topicIDPattern+"}", s.topicAnalytics)
+
+		r.With(s.requireAPIKey).Post("/topics", s.createTopic)
+		r.Route("/topic/{id:"+topicRoutePattern+"}", func(r chi.Router) {
+			r.Get("/", s.getTopic)
+			r.With(noWildcard, s.requireAPIKey).Put("/", s.updateTopic)
+			r.With(s.requireAdmin).Get("/subscriptions", s.listSubscriptions)
+			r.With(s.ipRateLimit).Post("/subscribe", s.subscribe)
+			r.With(s.ipRateLimit).Post("/unsubscribe", s.unsubscribe)
+			r.With(noWildcard, s.requireAPIKey).Delete("/", s.deleteTopic)
+			r.With(noWildcard, s.requireAPIKey).Post("/push", s.sendNotification)
 		})
 	})
 
@@ -57,46 +101,177 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 
 	data := &subscriptionRequest{}
 	if err := render.Bind(r, data); err != nil {
-		render.JSON(w, r, newErrorResponse(fmt.Sprintf("failed to bind request: %v", err)))
+		render.Render(w, r, errBind(err))
 		return
 	}
 
+	if err := push.CheckEndpoint(data.Subscription.Endpoint, s.config.PushHostAllowlist); err != nil {
+		render.Render(w, r, errBind(validationErrors{{Field: "subscription.endpoint", Message: err.Error()}}))
+		return
+	}
+
+	registered, err := s.store.GetTopic(topicId)
+	if err != nil && err != store.ErrNotFound {
+		render.Render(w, r, errInternal("failed to get topic", err))
+		return
+	}
+	if registered.Archived {
+		render.Render(w, r, errConflict("topic is archived"))
+		return
+	}
+
+	var existing *push.Subscription
+	if subscription, err := s.store.FindSubscription(topicId, data.Subscription.Endpoint); err == nil {
+		existing = &subscription
+	} else if err != store.ErrNotFound {
+		render.Render(w, r, errInternal("failed to get subscription", err))
+		return
+	}
+
+	if max := s.config.MaxTopicSubscriptions; max > 0 && existing == nil {
+		count, err := s.store.CountSubscriptions(topicId)
+		if err != nil {
+			render.Render(w, r, errInternal("failed to count subscriptions", err))
+			return
+		}
+		if count >= max {
+			render.Render(w, r, errConflict("topic has reached its subscription limit"))
+			return
+		}
+	}
+
+	now := time.Now().UTC()
 	subscription := push.Subscription{
-		Subscription: data.Subscription,
+		Subscription: data.Subscription.Subscription,
 		Topic:        topicId,
 		ID:           uuid.New().String(),
+		Timezone:     data.Timezone,
+		QuietHours:   data.QuietHours,
+		CreatedAt:    now,
+		RefreshedAt:  now,
+	}
+
+	// subscribing again with the same endpoint refreshes the existing subscription
+	if existing != nil {
+		subscription.ID = existing.ID
+		subscription.CreatedAt = existing.CreatedAt
+	}
+
+	if data.Subscription.ExpirationTime != nil {
+		expiresAt := time.UnixMilli(*data.Subscription.ExpirationTime).UTC()
+		subscription.ExpiresAt = &expiresAt
+	}
+
+	if s.config.VerifySubscriptions == VerifyModeReject || s.config.VerifySubscriptions == VerifyModeFlag {
+		if status := s.push.Verify(&subscription.Subscription, s.config.VerifyTitle); status == push.PushStatusHardFail {
+			if s.config.VerifySubscriptions == VerifyModeReject {
+				render.Render(w, r, errBadRequest("subscription was rejected by the push service"))
+				return
+			}
+			subscription.Flagged = true
+		}
+	}
+
+	if err := s.store.SetStruct(store.GetSubscriptionKey(topicId, subscription.ID), subscription); err != nil {
+		render.Render(w, r, errInternal("failed to store subscription", err))
+		return
 	}
 
-	s.store.SetStruct(store.GetSubscriptionKey(topicId, subscription.ID), subscription)
+	if existing == nil {
+		go s.replayNotifications(registered, subscription)
+	}
 
-	render.JSON(w, r, newSuccessResponse("subscription added"))
+	render.JSON(w, r, newSubscriptionResponse(subscription.ID, "subscription added"))
+}
+
+// unsubscribe removes the subscription of an endpoint to a topic, for
+// browsers that present its auth secret.
+func (s *Server) unsubscribe(w http.ResponseWriter, r *http.Request) {
+	topicId := chi.URLParam(r, "id")
+
+	data := &unsubscriptionRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	subscription, err := s.store.FindSubscription(topicId, data.Subscription.Endpoint)
+	if err != nil && err != store.ErrNotFound {
+		render.Render(w, r, errInternal("failed to get subscription", err))
+		return
+	}
+	// a wrong secret looks like an unknown endpoint
+	if err == store.ErrNotFound || subtle.ConstantTimeCompare([]byte(subscription.Keys.Auth), []byte(data.Subscription.Keys.Auth)) != 1 {
+		render.Render(w, r, errNotFound("subscription not found"))
+		return
+	}
+
+	var b store.Batch
+	b.DeleteSubscription(subscription)
+	if err := s.store.Apply(&b); err != nil {
+		render.Render(w, r, errInternal("failed to delete subscription", err))
+		return
+	}
+
+	render.JSON(w, r, newSubscriptionResponse(subscription.ID, "subscription removed"))
 }
 
 func (s *Server) status(w http.ResponseWriter, r *http.Request) {
-	// get all the scheduled jobs
-	schedulerJobs := s.scheduler.Jobs()
-
-	jobs := make([]jobStatus, 0, len(schedulerJobs))
-	for _, job := range schedulerJobs {
-		jobs = append(jobs, jobStatus{
-			Tags:      job.Tags(),
-			StartTime: job.NextRun().Format(time.RFC3339),
-		})
+	jobs := s.scheduler.Len()
+
+	topics, err := s.store.CountTopics()
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count topics", err))
+		return
+	}
+
+	notifications, err := s.store.CountNotifications("*")
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count notifications", err))
+		return
+	}
+
+	subscriptions, err := s.store.CountSubscriptions("*")
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count subscriptions", err))
+		return
+	}
+
+	hosts, err := s.store.CountSubscriptionsByHost()
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count subscriptions", err))
+		return
+	}
+
+	resp := newStatusResponse(jobs, topics, notifications, subscriptions, hosts)
+	if due, ok, err := s.store.NextDue(); err != nil {
+		render.Render(w, r, errInternal("failed to get the next notification", err))
+		return
+	} else if ok {
+		resp.NextDue = &due
 	}
 
-	notifications, err := s.store.GetNotifications()
+	render.JSON(w, r, resp)
+}
+
+func (s *Server) janitorReport(w http.ResponseWriter, r *http.Request) {
+	stale, err := s.pruneSubscriptions(true)
 	if err != nil {
-		render.JSON(w, r, newErrorResponse(fmt.Sprintf("failed to get notifications: %v", err)))
+		render.Render(w, r, errInternal("failed to find stale subscriptions", err))
 		return
 	}
 
-	subscriptions, err := s.store.GetSubscriptions("*")
+	render.JSON(w, r, newJanitorResponse(stale, true))
+}
+
+func (s *Server) runJanitor(w http.ResponseWriter, r *http.Request) {
+	stale, err := s.pruneSubscriptions(false)
 	if err != nil {
-		render.JSON(w, r, newErrorResponse(fmt.Sprintf("failed to get subscriptions: %v", err)))
+		render.Render(w, r, errInternal("failed to prune subscriptions", err))
 		return
 	}
 
-	render.JSON(w, r, newStatusResponse(jobs, notifications, subscriptions))
+	render.JSON(w, r, newJanitorResponse(stale, false))
 }
 
 func (s *Server) getVapidKey(w http.ResponseWriter, r *http.Request) {
@@ -105,32 +280,39 @@ func (s *Server) getVapidKey(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, resp)
 }
 
-func (s *Server) topicCtx(next http.Handler) http.Handler {
+func (s *Server) limitBody(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		topicId := chi.URLParam(r, "id")
-
-		subscriptions, err := s.store.GetSubscriptions(topicId)
-		if err != nil {
-			render.JSON(w, r, newErrorResponse(fmt.Sprintf("failed to get subscriptions: %v", err)))
-			return
+		// imports are as large as the store, admin routes are trusted
+		if r.Body != nil && !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxBodyBytes)
 		}
-
-		ctx := context.WithValue(r.Context(), store.KeyTopic, subscriptions)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
 	})
 }
 
-func (s *Server) getTopic(w http.ResponseWriter, r *http.Request) {
-	topic := r.Context().Value(store.KeyTopic).([]push.Subscription)
+// ipRateLimit limits requests per client ip, as resolved by middleware.RealIP.
+func (s *Server) ipRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
 
-	render.JSON(w, r, newTopicResponse(topic))
+		if ok, wait := s.subscribeLimiter.allow(ip, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			render.Render(w, r, errRateLimited())
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) deleteTopic(w http.ResponseWriter, r *http.Request) {
 	topicId := chi.URLParam(r, "id")
 
 	if err := s.store.DeleteTopic(topicId); err != nil {
-		render.JSON(w, r, newErrorResponse(fmt.Sprintf("failed to delete topic: %v", err)))
+		render.Render(w, r, errInternal("failed to delete topic", err))
 		return
 	}
 
@@ -145,25 +327,75 @@ func (s *Server) sendNotification(w http.ResponseWriter, r *http.Request) {
 
 	reqData := &notificationRequest{}
 	if err := render.Bind(r, reqData); err != nil {
-		render.JSON(w, r, newErrorResponse(fmt.Sprintf("failed to bind request: %v", err)))
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	topic, err := s.store.GetTopic(topicId)
+	if err != nil && err != store.ErrNotFound {
+		render.Render(w, r, errInternal("failed to get topic", err))
+		return
+	}
+	if topic.Archived {
+		render.Render(w, r, errConflict("topic is archived"))
 		return
 	}
 
+	// a retried request with the same Idempotency-Key gets the original response
+	idempotencyKey := ""
+	fingerprint := ""
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		idempotencyKey = store.GetIdempotencyKey(topicId, r.Header.Get("X-API-Key"), key)
+		fingerprint = requestFingerprint(reqData)
+		if s.replayIdempotent(w, r, idempotencyKey, fingerprint) {
+			return
+		}
+	}
+
+	reqData.applyDefaults(topic.Defaults)
+
 	webPushPayload := push.PushPayload{
-		Title: reqData.Title,
-		Body:  reqData.Body,
-		Icon:  reqData.Icon,
+		Title:    reqData.Title,
+		Body:     reqData.Body,
+		Icon:     reqData.Icon,
+		Redirect: reqData.Redirect,
 	}
 
-	notificationTime := time.Time{} // zero time
-	if reqData.Scheduled != "" {
-		// parse utc time
-		nt, err := time.Parse(time.RFC3339, reqData.Scheduled)
-		if err != nil {
-			render.JSON(w, r, newErrorResponse(fmt.Sprintf("failed to parse notification time: %v", err)))
+	notificationTime := reqData.scheduledAt // zero time unless scheduled
+
+	// apply the topic and api key rate limits, the latter only to keys
+	// requireAPIKey checked
+	apiKey := ""
+	if len(s.config.APIKeys) > 0 {
+		apiKey = r.Header.Get("X-API-Key")
+	}
+	now := time.Now()
+	allowedAt := s.topicLimiter.next(topicId, now)
+	if apiKey != "" {
+		if at := s.apiKeyLimiter.next(apiKey, now); at.After(allowedAt) {
+			allowedAt = at
+		}
+	}
+
+	queued := false
+	if allowedAt.After(now) {
+		// local times are sent in each timezone in turn, they can't be held back
+		if !s.config.RateLimitQueue || reqData.LocalTime {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(allowedAt.Sub(now).Seconds()))))
+			render.Render(w, r, errRateLimited())
 			return
 		}
-		notificationTime = nt
+
+		// hold the notification back until the limit allows it
+		if notificationTime.Before(allowedAt) {
+			notificationTime = allowedAt
+			queued = true
+		}
+	}
+
+	s.topicLimiter.record(topicId, allowedAt)
+	if apiKey != "" {
+		s.apiKeyLimiter.record(apiKey, allowedAt)
 	}
 
 	instant := notificationTime.IsZero()
@@ -174,13 +406,79 @@ func (s *Server) sendNotification(w http.ResponseWriter, r *http.Request) {
 		Time:    notificationTime,
 		Payload: webPushPayload,
 		Options: reqData.NotificationOptions,
+
+		LocalTime: reqData.LocalTime,
+		Variants:  reqData.variants(webPushPayload),
+	}
+
+	message := "notification scheduled"
+	if queued {
+		message = "notification queued"
+	} else if instant {
+		message = "notification sent"
+	}
+
+	if idempotencyKey != "" {
+		record := idempotencyRecord{Fingerprint: fingerprint, ID: n.ID, Message: message}
+		set, err := s.store.SetStructIfAbsent(idempotencyKey, record, s.config.IdempotencyTTL)
+		if err != nil {
+			render.Render(w, r, errInternal("failed to store idempotency key", err))
+			return
+		}
+		// a concurrent request with the same key got there first
+		if !set && s.replayIdempotent(w, r, idempotencyKey, fingerprint) {
+			return
+		}
 	}
 
 	s.notifs <- &n
 
-	if instant {
-		render.JSON(w, r, newNotificationResponse(n.ID, "notification sent"))
-	} else {
-		render.JSON(w, r, newNotificationResponse(n.ID, "notification scheduled"))
+	render.JSON(w, r, newNotificationResponse(n.ID, message))
+}
+
+// replayIdempotent responds with the stored result of an earlier request
+// with the same idempotency key, reporting whether there was one.
+func (s *Server) replayIdempotent(w http.ResponseWriter, r *http.Request, key, fingerprint string) bool {
+	var record idempotencyRecord
+	if err := s.store.GetStruct(key, &record); err != nil {
+		if err != store.ErrNotFound {
+			render.Render(w, r, errInternal("failed to get idempotency key", err))
+			return true
+		}
+		return false
+	}
+
+	if record.Fingerprint != fingerprint {
+		render.Render(w, r, errConflict("Idempotency-Key was already used for a different request"))
+		return true
+	}
+
+	w.Header().Set("Idempotent-Replayed", "true")
+	render.JSON(w, r, newNotificationResponse(record.ID, record.Message))
+	return true
+}
+
+// requestFingerprint hashes a request body, to tell retries apart from
+// different requests reusing an idempotency key.
+func requestFingerprint(v interface{}) string {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScheduledTime parses an RFC 3339 time. Local times keep only the wall
+// clock, which may also be given without an offset.
+func parseScheduledTime(value string, local bool) (time.Time, error) {
+	if !local {
+		return time.Parse(time.RFC3339, value)
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02T15:04:05", value)
+		if err != nil {
+			return time.Time{}, err
+		}
 	}
+	return push.WallTime(t, time.UTC), nil
 }
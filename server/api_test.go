@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
+)
+
+func newTestServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	db, err := store.Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	if config.MaxBodyBytes == 0 {
+		config.MaxBodyBytes = 64 * 1024
+	}
+	if config.RateLimitWindow == 0 {
+		config.RateLimitWindow = time.Minute
+	}
+	if config.VerifySubscriptions == "" {
+		config.VerifySubscriptions = VerifyModeOff
+	}
+
+	s := NewServer(config, db)
+	t.Cleanup(func() {
+		s.scheduler.Stop()
+		db.Close()
+	})
+	return s
+}
+
+// serve sends a request to the server's router, body is encoded as json
+// when not nil, and decodes the response into out when not nil.
+func serve(t *testing.T, s *Server, method, path string, header http.Header, body, out interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &reqBody)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, req)
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+func TestDeleteTopic(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, topic := range []string{"sports", "sports.football"} {
+		if err := s.store.SetTopic(push.Topic{ID: topic}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		topic  string
+		status int
+		kept   []string
+	}{
+		{"sports.*", http.StatusBadRequest, []string{"sports", "sports.football"}},
+		{"sports", http.StatusOK, []string{"sports.football"}},
+	}
+	for _, tt := range tests {
+		rec := serve(t, s, http.MethodDelete, "/api/topic/"+tt.topic, nil, nil, nil)
+		if rec.Code != tt.status {
+			t.Errorf("DELETE %s: got status %d, want %d", tt.topic, rec.Code, tt.status)
+		}
+		for _, topic := range tt.kept {
+			if _, err := s.store.GetTopic(topic); err != nil {
+				t.Errorf("DELETE %s: topic %s: %v, want it kept", tt.topic, topic, err)
+			}
+		}
+	}
+}
+
+func TestPushIdempotency(t *testing.T) {
+	s := newTestServer(t, Config{})
+	idempotent := func(key, apiKey string) http.Header {
+		header := http.Header{"Idempotency-Key": {key}}
+		if apiKey != "" {
+			header.Set("X-API-Key", apiKey)
+		}
+		return header
+	}
+	hi := map[string]interface{}{"title": "hi"}
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		body     map[string]interface{}
+		status   int
+		replayed bool
+		sameID   bool
+	}{
+		{"first request", idempotent("k1", ""), hi, http.StatusOK, false, false},
+		{"retry", idempotent("k1", ""), hi, http.StatusOK, true, true},
+		{"different body", idempotent("k1", ""), map[string]interface{}{"title": "bye"}, http.StatusConflict, false, false},
+		{"other api key", idempotent("k1", "other"), hi, http.StatusOK, false, false},
+		{"other key", idempotent("k2", ""), hi, http.StatusOK, false, false},
+		{"no key", nil, hi, http.StatusOK, false, false},
+	}
+
+	first := ""
+	for _, tt := range tests {
+		var resp notificationResponse
+		w := serve(t, s, http.MethodPost, "/api/topic/news/push", tt.header, tt.body, &resp)
+		if w.Code != tt.status {
+			t.Fatalf("%s: got status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+			t.Errorf("%s: got replayed %v, want %v", tt.name, replayed, tt.replayed)
+		}
+		if first == "" {
+			first = resp.ID
+			continue
+		}
+		if tt.status == http.StatusOK && (resp.ID == first) != tt.sameID {
+			t.Errorf("%s: got id %s, first was %s", tt.name, resp.ID, first)
+		}
+	}
+}
+
+func TestListsRequireAdmin(t *testing.T) {
+	s := newTestServer(t, Config{AdminKey: "secret", APIKeys: []string{"a"}})
+	sub := newPushService(t).subscription("news", "s1", "")
+	if err := s.store.AddSubscriptions([]push.Subscription{sub}); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{"/api/topic/news/subscriptions", "/api/notifications", "/api/notifications/due"}
+	for _, path := range paths {
+		for _, header := range []http.Header{nil, {"X-Api-Key": {"a"}}, {"X-Admin-Key": {"wrong"}}} {
+			if w := serve(t, s, http.MethodGet, path, header, nil, nil); w.Code != http.StatusUnauthorized {
+				t.Errorf("%s with %v: got status %d, want 401", path, header, w.Code)
+			}
+		}
+		if w := serve(t, s, http.MethodGet, path, http.Header{"X-Admin-Key": {"secret"}}, nil, nil); w.Code != http.StatusOK {
+			t.Errorf("%s with the admin key: got status %d", path, w.Code)
+		}
+	}
+
+	w := serve(t, s, http.MethodGet, "/api/topic/news/subscriptions", http.Header{"X-Admin-Key": {"secret"}}, nil, nil)
+	if !strings.Contains(w.Body.String(), sub.Endpoint) || strings.Contains(w.Body.String(), `"keys"`) || strings.Contains(w.Body.String(), sub.Keys.Auth) {
+		t.Errorf("got %s, want the subscription without its keys", w.Body)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	s := newTestServer(t, Config{})
+	ps := newPushService(t)
+	news := ps.subscription("news", "s1", "")
+	wildcard := ps.subscription("news.*", "w1", "")
+	if err := s.store.AddSubscriptions([]push.Subscription{news, wildcard, ps.subscription("sports", "s1", "")}); err != nil {
+		t.Fatal(err)
+	}
+
+	body := func(subscription push.Subscription, auth string) interface{} {
+		return map[string]interface{}{
+			"subscription": map[string]interface{}{
+				"endpoint": subscription.Endpoint,
+				"keys":     map[string]string{"auth": auth},
+			},
+		}
+	}
+	tests := []struct {
+		name   string
+		topic  string
+		body   interface{}
+		status int
+	}{
+		{"no auth", "news", body(news, ""), http.StatusBadRequest},
+		{"wrong auth", "news", body(news, "wrong"), http.StatusNotFound},
+		{"unknown endpoint", "news", body(ps.subscription("news", "other", ""), news.Keys.Auth), http.StatusNotFound},
+		{"subscribed", "news", body(news, news.Keys.Auth), http.StatusOK},
+		{"again", "news", body(news, news.Keys.Auth), http.StatusNotFound},
+		{"wildcard", "news.*", body(wildcard, wildcard.Keys.Auth), http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := serve(t, s, http.MethodPost, "/api/topic/"+tt.topic+"/unsubscribe", nil, tt.body, nil); w.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	// the endpoint's subscriptions to other topics are kept
+	for topic, want := range map[string]int{"news": 0, "news.*": 0, "sports": 1} {
+		if count, _ := s.store.CountSubscriptions(topic); count != want {
+			t.Errorf("%s: got %d subscriptions, want %d", topic, count, want)
+		}
+	}
+}
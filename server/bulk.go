@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
+
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+// subscriptions stored per transaction by a bulk import
+const bulkBatchSize = 500
+
+type ImportFormat string
+
+const (
+	ImportFormatJSONLines ImportFormat = "jsonl"
+	ImportFormatCSV       ImportFormat = "csv"
+)
+
+// SubscriptionImport configures a bulk import of raw browser subscriptions.
+type SubscriptionImport struct {
+	Format ImportFormat
+	// topic of the lines that don't name one
+	Topic string
+	// public key of the key pair the subscriptions were made with, empty for
+	// the server's own; other pairs must be added first
+	VapidKey string
+	// hosts endpoints may point at
+	AllowedHosts []string
+}
+
+type SubscriptionImportResult struct {
+	Imported int                 `json:"imported"`
+	Skipped  int                 `json:"skipped"`
+	Errors   []store.ImportError `json:"errors"`
+}
+
+// bulkSubscription is a line of a bulk import: a PushSubscription as
+// serialized by the browser, optionally with a topic and timezone.
+type bulkSubscription struct {
+	browserSubscription
+	Topic    string `json:"topic,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// ImportSubscriptions streams subscriptions into the store in batches,
+// skipping endpoints already subscribed to their topic and reporting the
+// lines that fail validation.
+func ImportSubscriptions(st *store.Store, r io.Reader, opts SubscriptionImport) (SubscriptionImportResult, error) {
+	result := SubscriptionImportResult{Errors: make([]store.ImportError, 0)}
+
+	if opts.VapidKey != "" {
+		keys, err := st.GetVapidKeys()
+		if err != nil {
+			return result, err
+		}
+		if opts.VapidKey == keys.VAPIDPublicKey {
+			opts.VapidKey = ""
+		} else if _, err := st.GetVapidKeyPair(opts.VapidKey); err == store.ErrNotFound {
+			return result, fmt.Errorf("unknown vapid key, add the key pair first")
+		} else if err != nil {
+			return result, err
+		}
+	}
+
+	// topics and endpoints of the lines so far
+	seen := make(map[string]bool)
+	batch := make([]push.Subscription, 0, bulkBatchSize)
+	now := time.Now().UTC()
+
+	add := func(line int, row bulkSubscription) error {
+		subscription, err := opts.subscription(row, now)
+		if err != nil {
+			result.Errors = append(result.Errors, store.ImportError{Line: line, Message: err.Error()})
+			return nil
+		}
+
+		id := subscription.Topic + " " + subscription.Endpoint
+		if seen[id] {
+			result.Skipped++
+			return nil
+		}
+		seen[id] = true
+		if _, err := st.FindSubscription(subscription.Topic, subscription.Endpoint); err == nil {
+			result.Skipped++
+			return nil
+		} else if err != store.ErrNotFound {
+			return err
+		}
+
+		batch = append(batch, subscription)
+		if len(batch) < bulkBatchSize {
+			return nil
+		}
+		return flushSubscriptions(st, &batch, &result)
+	}
+
+	var err error
+	switch opts.Format {
+	case ImportFormatCSV:
+		err = readCSV(r, add, &result)
+	case ImportFormatJSONLines, "":
+		err = readJSONLines(r, add, &result)
+	default:
+		err = fmt.Errorf("unknown format %q", opts.Format)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	return result, flushSubscriptions(st, &batch, &result)
+}
+
+func flushSubscriptions(st *store.Store, batch *[]push.Subscription, result *SubscriptionImportResult) error {
+	if len(*batch) == 0 {
+		return nil
+	}
+	if err := st.AddSubscriptions(*batch); err != nil {
+		return err
+	}
+	result.Imported += len(*batch)
+	*batch = (*batch)[:0]
+	return nil
+}
+
+// subscription validates a line like the subscribe route does.
+func (opts SubscriptionImport) subscription(row bulkSubscription, now time.Time) (push.Subscription, error) {
+	topic := row.Topic
+	if topic == "" {
+		topic = opts.Topic
+	}
+	if !topicIDRegexp.MatchString(strings.TrimSuffix(topic, ".*")) {
+		return push.Subscription{}, fmt.Errorf("invalid topic %q", topic)
+	}
+
+	if row.Endpoint == "" || row.Keys.P256dh == "" || row.Keys.Auth == "" {
+		return push.Subscription{}, fmt.Errorf("endpoint, p256dh and auth are required")
+	}
+	if err := push.CheckEndpoint(row.Endpoint, opts.AllowedHosts); err != nil {
+		return push.Subscription{}, err
+	}
+	if err := push.ValidateKeys(&row.Subscription); err != nil {
+		return push.Subscription{}, err
+	}
+	if row.Timezone != "" {
+		if _, err := time.LoadLocation(row.Timezone); err != nil {
+			return push.Subscription{}, fmt.Errorf("unknown timezone %q", row.Timezone)
+		}
+	}
+
+	subscription := push.Subscription{
+		Subscription: row.Subscription,
+		ID:           uuid.New().String(),
+		Topic:        topic,
+		Timezone:     row.Timezone,
+		CreatedAt:    now,
+		RefreshedAt:  now,
+		VapidKey:     opts.VapidKey,
+	}
+	if row.ExpirationTime != nil {
+		expiresAt := time.UnixMilli(*row.ExpirationTime).UTC()
+		subscription.ExpiresAt = &expiresAt
+	}
+	return subscription, nil
+}
+
+func readJSONLines(r io.Reader, add func(int, bulkSubscription) error, result *SubscriptionImportResult) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var row bulkSubscription
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			result.Errors = append(result.Errors, store.ImportError{Line: line, Message: fmt.Sprintf("invalid json: %v", err)})
+			continue
+		}
+		if err := add(line, row); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readCSV reads rows with a header naming the endpoint, p256dh and auth
+// columns, and optionally topic and timezone.
+func readCSV(r io.Reader, add func(int, bulkSubscription) error, result *SubscriptionImportResult) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read csv header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"endpoint", "p256dh", "auth"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("csv header has no %s column", name)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return err
+			}
+			result.Errors = append(result.Errors, store.ImportError{Line: parseErr.Line, Message: parseErr.Err.Error()})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		var row bulkSubscription
+		row.Endpoint = field("endpoint")
+		row.Keys.P256dh = field("p256dh")
+		row.Keys.Auth = field("auth")
+		row.Topic = field("topic")
+		row.Timezone = field("timezone")
+		if err := add(line, row); err != nil {
+			return err
+		}
+	}
+}
+
+// importSubscriptions bulk imports subscriptions from JSON lines, or CSV
+// when sent as text/csv.
+func (s *Server) importSubscriptions(w http.ResponseWriter, r *http.Request) {
+	opts := SubscriptionImport{
+		Format:       ImportFormat(r.URL.Query().Get("format")),
+		Topic:        r.URL.Query().Get("topic"),
+		VapidKey:     r.URL.Query().Get("vapidKey"),
+		AllowedHosts: s.config.PushHostAllowlist,
+	}
+	if opts.Format == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		opts.Format = ImportFormatCSV
+	}
+	if opts.Format != "" && opts.Format != ImportFormatCSV && opts.Format != ImportFormatJSONLines {
+		render.Render(w, r, errBadRequest("format must be jsonl or csv"))
+		return
+	}
+	if opts.VapidKey != "" {
+		if _, ok := s.push.KeysFor(opts.VapidKey); !ok {
+			render.Render(w, r, errBadRequest("unknown vapid key, add the key pair first"))
+			return
+		}
+	}
+
+	result, err := ImportSubscriptions(s.store, r.Body, opts)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to import subscriptions", err))
+		return
+	}
+
+	render.JSON(w, r, newBulkImportResponse(result))
+}
+
+// addVapidKeys adds a key pair that imported subscriptions were made with.
+func (s *Server) addVapidKeys(w http.ResponseWriter, r *http.Request) {
+	data := &vapidKeysRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	if err := s.store.AddVapidKeyPair(data.VapidKeys); err != nil {
+		render.Render(w, r, errInternal("failed to add vapid keys", err))
+		return
+	}
+	s.push.AddVapidKeys(data.VapidKeys)
+
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, newSuccessResponse("vapid keys added"))
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+const (
+	testP256dh = "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM"
+	testAuth   = "tBHItJI5svbpez7KI4CCXg"
+)
+
+func jsonLine(endpoint, extra string) string {
+	return fmt.Sprintf(`{"endpoint":"https://push.example.com/%s","keys":{"p256dh":"%s","auth":"%s"}%s}`, endpoint, testP256dh, testAuth, extra)
+}
+
+func TestImportSubscriptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		format ImportFormat
+		input  []string
+		// topic and endpoint of each subscription stored
+		want    []string
+		skipped int
+		// lines reported as errors
+		errors []int
+	}{
+		{
+			name:   "json lines",
+			format: ImportFormatJSONLines,
+			input: []string{
+				jsonLine("a", ""),
+				`{"endpoint":`,
+				"",
+				jsonLine("a", ""),
+				`{"endpoint":"https://push.example.com/b","keys":{"p256dh":"BAAA","auth":"` + testAuth + `"}}`,
+				jsonLine("c", `,"topic":"sports.*","timezone":"Europe/Paris"`),
+				`{"endpoint":"https://evil.example.com/d","keys":{"p256dh":"` + testP256dh + `","auth":"` + testAuth + `"}}`,
+				jsonLine("e", `,"timezone":"Mars/Olympus"`),
+				jsonLine("f", `,"topic":"Bad Topic"`),
+				jsonLine("existing", ""),
+				jsonLine("g", `,"topic":"sports"`),
+			},
+			want:    []string{"news a", "sports g", "sports.* c"},
+			skipped: 2,
+			errors:  []int{2, 5, 7, 8, 9},
+		},
+		{
+			name:   "csv",
+			format: ImportFormatCSV,
+			input: []string{
+				"Endpoint, P256dh, Auth, Topic",
+				"https://push.example.com/a," + testP256dh + "," + testAuth,
+				"https://push.example.com/b," + testP256dh + ",short",
+				`https://push.example.com/c"x,` + testP256dh + "," + testAuth,
+				"https://push.example.com/a," + testP256dh + "," + testAuth,
+				"https://push.example.com/d," + testP256dh + "," + testAuth + ",sports",
+				"http://push.example.com/e," + testP256dh + "," + testAuth,
+			},
+			want:    []string{"news a", "sports d"},
+			skipped: 1,
+			errors:  []int{3, 4, 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{})
+			existing := newPushService(t).subscription("news", "existing", "")
+			existing.Endpoint = "https://push.example.com/existing"
+			if err := s.store.AddSubscriptions([]push.Subscription{existing}); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := ImportSubscriptions(s.store, strings.NewReader(strings.Join(tt.input, "\n")), SubscriptionImport{
+				Format:       tt.format,
+				Topic:        "news",
+				AllowedHosts: []string{"push.example.com"},
+			})
+			if err != nil {
+				t.Fatalf("import: %v", err)
+			}
+
+			lines := make([]int, 0, len(result.Errors))
+			for _, e := range result.Errors {
+				lines = append(lines, e.Line)
+			}
+			if fmt.Sprint(lines) != fmt.Sprint(tt.errors) {
+				t.Errorf("got errors %+v, want lines %v", result.Errors, tt.errors)
+			}
+			if result.Imported != len(tt.want) || result.Skipped != tt.skipped {
+				t.Errorf("got %d imported and %d skipped, want %d and %d", result.Imported, result.Skipped, len(tt.want), tt.skipped)
+			}
+
+			subscriptions, err := s.store.GetSubscriptions("*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(subscriptions))
+			for _, subscription := range subscriptions {
+				if subscription.ID == "existing" {
+					continue
+				}
+				got = append(got, subscription.Topic+" "+strings.TrimPrefix(subscription.Endpoint, "https://push.example.com/"))
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got subscriptions %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportSubscriptionsVapidKey(t *testing.T) {
+	s := newTestServer(t, Config{})
+	own, err := s.store.GetVapidKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vendor := push.GenerateVAPIDKeys()
+	if err := s.store.AddVapidKeyPair(vendor); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		vapidKey string
+		endpoint string
+		valid    bool
+		want     string
+	}{
+		{"server's own key", own.VAPIDPublicKey, "a", true, ""},
+		{"added key pair", vendor.VAPIDPublicKey, "b", true, vendor.VAPIDPublicKey},
+		{"unknown key", push.GenerateVAPIDKeys().VAPIDPublicKey, "c", false, ""},
+	}
+	for _, tt := range tests {
+		_, err := ImportSubscriptions(s.store, strings.NewReader(jsonLine(tt.endpoint, "")), SubscriptionImport{
+			Topic:        "news",
+			VapidKey:     tt.vapidKey,
+			AllowedHosts: []string{"push.example.com"},
+		})
+		if (err == nil) != tt.valid {
+			t.Fatalf("%s: got %v, want valid %v", tt.name, err, tt.valid)
+		}
+		if !tt.valid {
+			continue
+		}
+
+		subscription, err := s.store.FindSubscription("news", "https://push.example.com/"+tt.endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subscription.VapidKey != tt.want {
+			t.Errorf("%s: got vapid key %q, want %q", tt.name, subscription.VapidKey, tt.want)
+		}
+	}
+
+	if count, _ := s.store.CountSubscriptions("news"); count != 2 {
+		t.Errorf("got %d subscriptions, want 2", count)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+type Config struct {
+	Addr string
+
+	// keys accepted in the X-API-Key header of pushes, empty accepts any request
+	APIKeys []string
+
+	// notifications accepted per topic and per API key in each window, 0
+	// disables. API keys are only limited when they are configured.
+	TopicRateLimit  int
+	APIKeyRateLimit int
+	RateLimitWindow time.Duration
+	// queue notifications over the limit instead of rejecting them
+	RateLimitQueue bool
+
+	// outgoing sends per second to a single push service host, 0 disables
+	PushHostRate int
+
+	// subscribe requests per minute from a single ip, 0 disables
+	SubscribeRateLimit int
+	// subscriptions a single topic may hold, 0 disables
+	MaxTopicSubscriptions int
+	// largest accepted request body
+	MaxBodyBytes int64
+	// hosts subscription endpoints may point at
+	PushHostAllowlist []string
+	// what to do with new subscriptions that fail a verification push
+	VerifySubscriptions VerifyMode
+	// title of the notification the verification push shows
+	VerifyTitle string
+
+	// how long sent notifications are kept for replaying to new subscribers, 0 disables
+	HistoryRetention time.Duration
+
+	// how long the event counts of a sent notification are kept
+	StatsRetention time.Duration
+	// public base URL of the API, redirects are rewritten into tracked links when set
+	PublicURL string
+
+	// how long an Idempotency-Key is remembered
+	IdempotencyTTL time.Duration
+
+	// key required in the X-Admin-Key header of admin routes, empty disables them
+	AdminKey string
+
+	// how often stale subscriptions are pruned, 0 disables
+	JanitorInterval time.Duration
+	// consecutive failed sends before a subscription is pruned, 0 disables
+	MaxSubscriptionFailures int
+	// time since the last refresh before a subscription is pruned, 0 disables
+	MaxSubscriptionAge time.Duration
+}
+
+type VerifyMode string
+
+const (
+	// no verification push is sent
+	VerifyModeOff VerifyMode = "off"
+	// subscriptions that hard fail are rejected
+	VerifyModeReject VerifyMode = "reject"
+	// subscriptions that hard fail are stored, but flagged
+	VerifyModeFlag VerifyMode = "flag"
+)
+
+func ConfigFromEnv() Config {
+	port := getEnv("PORT", "8080")
+
+	return Config{
+		Addr: ":" + port,
+
+		APIKeys: getEnvList("API_KEYS", nil),
+
+		TopicRateLimit:  getEnvInt("TOPIC_RATE_LIMIT", 0),
+		APIKeyRateLimit: getEnvInt("API_KEY_RATE_LIMIT", 0),
+		RateLimitWindow: getEnvDuration("RATE_LIMIT_WINDOW", time.Minute),
+		RateLimitQueue:  getEnvBool("RATE_LIMIT_QUEUE", false),
+
+		PushHostRate: getEnvInt("PUSH_HOST_RATE", 0),
+
+		SubscribeRateLimit:    getEnvInt("SUBSCRIBE_RATE_LIMIT", 10),
+		MaxTopicSubscriptions: getEnvInt("MAX_TOPIC_SUBSCRIPTIONS", 0),
+		MaxBodyBytes:          int64(getEnvInt("MAX_BODY_BYTES", 64*1024)),
+		PushHostAllowlist:     getEnvList("PUSH_HOST_ALLOWLIST", push.DefaultPushHosts),
+		VerifySubscriptions:   VerifyMode(getEnv("VERIFY_SUBSCRIPTIONS", string(VerifyModeOff))),
+		VerifyTitle:           getEnv("VERIFY_TITLE", "Notifications are on"),
+
+		HistoryRetention: getEnvDuration("HISTORY_RETENTION", 7*24*time.Hour),
+
+		StatsRetention: getEnvDuration("STATS_RETENTION", 30*24*time.Hour),
+		PublicURL:      getEnv("PUBLIC_URL", ""),
+
+		IdempotencyTTL: getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+
+		AdminKey: getEnv("ADMIN_KEY", ""),
+
+		JanitorInterval:         getEnvDuration("JANITOR_INTERVAL", time.Hour),
+		MaxSubscriptionFailures: getEnvInt("MAX_SUBSCRIPTION_FAILURES", 5),
+		MaxSubscriptionAge:      getEnvDuration("MAX_SUBSCRIPTION_AGE", 0),
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("[ERROR] Invalid value for %s: %v", key, err)
+		return fallback
+	}
+	return i
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("[ERROR] Invalid value for %s: %v", key, err)
+		return fallback
+	}
+	return b
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("[ERROR] Invalid value for %s: %v", key, err)
+		return fallback
+	}
+	return d
+}
+
+func getEnvList(key string, fallback []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	list := make([]string, 0)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
+)
+
+const janitorTag = "job:janitor"
+
+type staleReason string
+
+const (
+	staleReasonExpired staleReason = "expired"
+	staleReasonFailing staleReason = "failing"
+	staleReasonStale   staleReason = "not refreshed"
+)
+
+type staleSubscription struct {
+	ID       string      `json:"id"`
+	Topic    string      `json:"topic"`
+	Endpoint string      `json:"endpoint"`
+	Reason   staleReason `json:"reason"`
+}
+
+// staleReasonFor returns why a subscription should be pruned, if it should be.
+func (s *Server) staleReasonFor(subscription push.Subscription, now time.Time) (staleReason, bool) {
+	if subscription.ExpiresAt != nil && subscription.ExpiresAt.Before(now) {
+		return staleReasonExpired, true
+	}
+	if max := s.config.MaxSubscriptionFailures; max > 0 && subscription.Failures >= max {
+		return staleReasonFailing, true
+	}
+	// subscriptions stored before refreshes were tracked have no refresh time
+	if age := s.config.MaxSubscriptionAge; age > 0 && !subscription.RefreshedAt.IsZero() && now.Sub(subscription.RefreshedAt) > age {
+		return staleReasonStale, true
+	}
+	return "", false
+}
+
+// subscriptions read and pruned per transaction
+const janitorPageSize = 500
+
+// pruneSubscriptions removes stale subscriptions, or only reports them on a
+// dry run. It reads a page at a time, and checks each subscription again
+// when deleting it, so one refreshed or sent to since it was read is kept.
+func (s *Server) pruneSubscriptions(dryRun bool) ([]staleSubscription, error) {
+	now := time.Now()
+	stale := make([]staleSubscription, 0)
+	isStale := func(subscription push.Subscription) bool {
+		_, ok := s.staleReasonFor(subscription, now)
+		return ok
+	}
+
+	// the plain, then the wildcard subscriptions of every topic
+	for _, topic := range []string{"*", "*.*"} {
+		after := ""
+		for {
+			subscriptions, next, err := s.store.GetSubscriptionsPage(topic, after, janitorPageSize, isStale)
+			if err != nil {
+				return nil, err
+			}
+
+			var b store.Batch
+			for _, subscription := range subscriptions {
+				reason, _ := s.staleReasonFor(subscription, now)
+				stale = append(stale, staleSubscription{
+					ID:       subscription.ID,
+					Topic:    subscription.Topic,
+					Endpoint: subscription.Endpoint,
+					Reason:   reason,
+				})
+				b.DeleteSubscriptionIf(subscription, isStale)
+			}
+			if !dryRun {
+				if err := s.store.Apply(&b); err != nil {
+					return nil, err
+				}
+			}
+
+			if next == "" {
+				break
+			}
+			after = next
+		}
+	}
+	return stale, nil
+}
+
+func (s *Server) startJanitor() {
+	if s.config.JanitorInterval <= 0 {
+		return
+	}
+
+	s.scheduler.scheduleEvery(s.config.JanitorInterval, janitorTag, func() {
+		stale, err := s.pruneSubscriptions(false)
+		if err != nil {
+			log.Printf("[ERROR] Failed to prune subscriptions: %v", err)
+			return
+		}
+		log.Printf("[INFO] Pruned %d stale subscriptions", len(stale))
+	})
+}
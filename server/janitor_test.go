@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+func TestPruneSubscriptions(t *testing.T) {
+	s := newTestServer(t, Config{MaxSubscriptionFailures: 3, MaxSubscriptionAge: time.Hour})
+	ps := newPushService(t)
+
+	expired := time.Now().Add(-time.Minute)
+	subscriptions := map[string]func(*push.Subscription){
+		"fresh":    func(sub *push.Subscription) { sub.RefreshedAt = time.Now() },
+		"legacy":   func(sub *push.Subscription) {},
+		"failing":  func(sub *push.Subscription) { sub.Failures = 3 },
+		"old":      func(sub *push.Subscription) { sub.RefreshedAt = time.Now().Add(-2 * time.Hour) },
+		"expired":  func(sub *push.Subscription) { sub.ExpiresAt = &expired },
+		"wildcard": func(sub *push.Subscription) { sub.Failures = 5 },
+	}
+	var stored []push.Subscription
+	for id, update := range subscriptions {
+		topic := "news"
+		if id == "wildcard" {
+			topic = "news.*"
+		}
+		subscription := ps.subscription(topic, id, "")
+		update(&subscription)
+		stored = append(stored, subscription)
+	}
+	if err := s.store.AddSubscriptions(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	prune := func(dryRun bool) string {
+		t.Helper()
+		stale, err := s.pruneSubscriptions(dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0, len(stale))
+		for _, subscription := range stale {
+			got = append(got, subscription.ID+" "+string(subscription.Reason))
+		}
+		sort.Strings(got)
+		return fmt.Sprint(got)
+	}
+
+	want := "[expired expired failing failing old not refreshed wildcard failing]"
+	if got := prune(true); got != want {
+		t.Errorf("dry run: got %s, want %s", got, want)
+	}
+	if count, _ := s.store.CountSubscriptions("*"); count != 6 {
+		t.Errorf("after a dry run: got %d subscriptions, want 6", count)
+	}
+
+	if got := prune(false); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if count, _ := s.store.CountSubscriptions("*"); count != 2 {
+		t.Errorf("got %d subscriptions, want the fresh and legacy ones", count)
+	}
+	if got := prune(false); got != "[]" {
+		t.Errorf("pruning again: got %s", got)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+var errInvalidLink = errors.New("invalid link")
+
+// redirectLink is carried in the token of a signed /r/{token} link.
+type redirectLink struct {
+	Notification string `json:"n"`
+	Subscription string `json:"s"`
+	URL          string `json:"u"`
+}
+
+// trackToken is carried in the payload of each delivery, for the service
+// worker to report the events of that delivery only.
+type trackToken struct {
+	Notification string `json:"n"`
+	Subscription string `json:"s"`
+	Variant      string `json:"v,omitempty"`
+}
+
+// linkSigner signs redirect links and tracking tokens so they cannot be
+// forged to count events or to redirect elsewhere.
+type linkSigner struct {
+	secret []byte
+}
+
+// newLinkSigner signs with the secret kept in the store, generating it on
+// first use so that links survive restarts.
+func newLinkSigner(store *store.Store) *linkSigner {
+	secret, err := store.GetLinkSecret()
+	if err != nil {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal("[ERROR] Failed to generate link secret: ", err)
+		}
+		if err := store.SetLinkSecret(secret); err != nil {
+			log.Fatal("[ERROR] Failed to set link secret: ", err)
+		}
+	}
+	return &linkSigner{secret: secret}
+}
+
+// derive returns a signer for tokens of another purpose, whose tokens l
+// doesn't accept and the other way around.
+func (l *linkSigner) derive(purpose string) *linkSigner {
+	h := hmac.New(sha256.New, l.secret)
+	h.Write([]byte(purpose))
+	return &linkSigner{secret: h.Sum(nil)}
+}
+
+func (l *linkSigner) sign(v interface{}) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(l.mac(payload))
+}
+
+// verify decodes a signed token into v.
+func (l *linkSigner) verify(token string, v interface{}) error {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return errInvalidLink
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, l.mac(payload)) {
+		return errInvalidLink
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return errInvalidLink
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errInvalidLink
+	}
+	return nil
+}
+
+// mac is truncated to keep links short, the redirect urls they carry are
+// limited to maxRedirectLength.
+func (l *linkSigner) mac(payload string) []byte {
+	h := hmac.New(sha256.New, l.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)[:16]
+}
+
+// trackedRedirect rewrites the redirect of a notification into a signed link
+// for the subscription, when the public URL of the API is configured.
+func (s *Server) trackedRedirect(notificationID, redirect string, subscription push.Subscription) string {
+	if redirect == "" || s.config.PublicURL == "" {
+		return redirect
+	}
+
+	token := s.links.sign(redirectLink{
+		Notification: notificationID,
+		Subscription: subscription.ID,
+		URL:          redirect,
+	})
+	return strings.TrimSuffix(s.config.PublicURL, "/") + "/r/" + token
+}
+
+// trackingToken signs the token a delivery's service worker reports its
+// events with.
+func (s *Server) trackingToken(notificationID string, subscription push.Subscription, variant string) string {
+	return s.tracking.sign(trackToken{
+		Notification: notificationID,
+		Subscription: subscription.ID,
+		Variant:      variant,
+	})
+}
+
+// redirect records the click of a signed link and sends the browser on to
+// the original URL.
+func (s *Server) redirect(w http.ResponseWriter, r *http.Request) {
+	var link redirectLink
+	if err := s.links.verify(chi.URLParam(r, "token"), &link); err != nil {
+		render.Render(w, r, errNotFound("unknown link"))
+		return
+	}
+
+	s.recordClick(link)
+
+	http.Redirect(w, r, link.URL, http.StatusFound)
+}
+
+// recordClick counts the first click of each subscription, as long as the
+// notification's stats are kept. Failures never block the redirect.
+func (s *Server) recordClick(link redirectLink) {
+	sent, err := s.store.GetSent(link.Notification)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Printf("[ERROR] Failed to get notification %s: %v", link.Notification, err)
+		}
+		return
+	}
+
+	first, err := s.store.AddClick(store.Click{
+		Notification: link.Notification,
+		Subscription: link.Subscription,
+		ClickedAt:    time.Now().UTC(),
+	}, s.config.StatsRetention)
+	if err != nil {
+		log.Printf("[ERROR] Failed to record click: %v", err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	// attribute the click to the variant the subscription got
+	variant := ""
+	if len(sent.Variants) > 0 {
+		variant, err = s.store.GetAssignment(link.Notification, link.Subscription)
+		if err != nil && err != store.ErrNotFound {
+			log.Printf("[ERROR] Failed to get variant of notification %s: %v", link.Notification, err)
+		}
+	}
+
+	if err := s.store.IncrStats(sent, variant, push.EventClicked, 1, s.config.StatsRetention); err != nil {
+		log.Printf("[ERROR] Failed to count click: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// pageParams reads the limit and cursor query parameters. Cursors are opaque
+// to clients, but are the store key the page ends at.
+func pageParams(r *http.Request) (limit int, after string, err error) {
+	var errs validationErrors
+
+	limit = defaultPageLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		errs.check(err == nil && limit > 0 && limit <= maxPageLimit, "limit", "must be between 1 and "+strconv.Itoa(maxPageLimit))
+	}
+
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		errs.check(err == nil, "cursor", "is invalid")
+		after = string(b)
+	}
+
+	return limit, after, errs.err()
+}
+
+func encodeCursor(key string) string {
+	if key == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func (s *Server) listTopics(w http.ResponseWriter, r *http.Request) {
+	limit, after, err := pageParams(r)
+	if err != nil {
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	// filtered before paging, so pages stay full
+	var filter func(push.Topic) bool
+	if archived := r.URL.Query().Get("archived"); archived != "" {
+		filter = func(topic push.Topic) bool {
+			return strconv.FormatBool(topic.Archived) == archived
+		}
+	}
+
+	names, next, err := s.store.GetTopics(r.URL.Query().Get("prefix"), after, limit, filter)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to get topics", err))
+		return
+	}
+
+	topics := make([]topicSummary, 0, len(names))
+	for _, name := range names {
+		topic, err := s.store.GetTopic(name)
+		if err == store.ErrNotFound {
+			topic = push.Topic{ID: name}
+		} else if err != nil {
+			render.Render(w, r, errInternal("failed to get topic", err))
+			return
+		}
+
+		count, err := s.store.CountSubscriptions(name)
+		if err != nil {
+			render.Render(w, r, errInternal("failed to count subscriptions", err))
+			return
+		}
+		topics = append(topics, topicSummary{Topic: topic, Subscriptions: count})
+	}
+
+	render.JSON(w, r, newTopicsResponse(topics, encodeCursor(next)))
+}
+
+func (s *Server) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	topicId := chi.URLParam(r, "id")
+
+	limit, after, err := pageParams(r)
+	if err != nil {
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	query := r.URL.Query()
+	timezone := query.Get("timezone")
+	host := query.Get("host")
+	flagged := query.Get("flagged")
+
+	filter := func(subscription push.Subscription) bool {
+		if timezone != "" && subscription.Location().String() != timezone {
+			return false
+		}
+		if host != "" && !strings.HasPrefix(subscription.Endpoint, "https://"+host+"/") {
+			return false
+		}
+		if flagged != "" && strconv.FormatBool(subscription.Flagged) != flagged {
+			return false
+		}
+		return true
+	}
+
+	subscriptions, next, err := s.store.GetSubscriptionsPage(topicId, after, limit, filter)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to get subscriptions", err))
+		return
+	}
+
+	total, err := s.store.CountSubscriptions(topicId)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count subscriptions", err))
+		return
+	}
+
+	render.JSON(w, r, newSubscriptionsResponse(subscriptions, total, encodeCursor(next)))
+}
+
+func (s *Server) listNotifications(w http.ResponseWriter, r *http.Request) {
+	limit, after, err := pageParams(r)
+	if err != nil {
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	if topic == "" {
+		topic = "*"
+	}
+
+	var errs validationErrors
+	var before, since time.Time
+	if v := query.Get("before"); v != "" {
+		before, err = time.Parse(time.RFC3339, v)
+		errs.check(err == nil, "before", "must be an RFC 3339 time")
+	}
+	if v := query.Get("after"); v != "" {
+		since, err = time.Parse(time.RFC3339, v)
+		errs.check(err == nil, "after", "must be an RFC 3339 time")
+	}
+	if err := errs.err(); err != nil {
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	filter := func(notification push.Notification) bool {
+		if !before.IsZero() && !notification.Time.Before(before) {
+			return false
+		}
+		if !since.IsZero() && !notification.Time.After(since) {
+			return false
+		}
+		return true
+	}
+
+	notifications, next, err := s.store.GetNotificationsPage(topic, after, limit, filter)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to get notifications", err))
+		return
+	}
+
+	total, err := s.store.CountNotifications(topic)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count notifications", err))
+		return
+	}
+
+	render.JSON(w, r, newNotificationsResponse(notifications, total, encodeCursor(next)))
+}
+
+// listDueNotifications returns the pending notifications in the order they
+// are due, across all topics.
+func (s *Server) listDueNotifications(w http.ResponseWriter, r *http.Request) {
+	var errs validationErrors
+	limit := defaultPageLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		errs.check(err == nil && limit > 0 && limit <= maxPageLimit, "limit", "must be between 1 and "+strconv.Itoa(maxPageLimit))
+	}
+	if err := errs.err(); err != nil {
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	notifications, err := s.store.GetDueNotifications(limit)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to get notifications", err))
+		return
+	}
+
+	total, err := s.store.CountNotifications("*")
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count notifications", err))
+		return
+	}
+
+	render.JSON(w, r, newNotificationsResponse(notifications, total, ""))
+}
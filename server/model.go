@@ -1,21 +1,88 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
 
 	webpush "github.com/SherClockHolmes/webpush-go"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
 )
 
 // requests
 
+// browserSubscription is a PushSubscription as serialized by the browser.
+type browserSubscription struct {
+	webpush.Subscription
+
+	// milliseconds since the epoch
+	ExpirationTime *int64 `json:"expirationTime,omitempty"`
+}
+
 type subscriptionRequest struct {
-	Subscription webpush.Subscription `json:"subscription"`
+	Subscription browserSubscription `json:"subscription"`
+	Timezone     string              `json:"timezone,omitempty"`
+	QuietHours   *push.QuietHours    `json:"quietHours,omitempty"`
 }
 
 func (sr *subscriptionRequest) Bind(r *http.Request) error {
-	return nil
+	var errs validationErrors
+
+	errs.check(sr.Subscription.Endpoint != "", "subscription.endpoint", "is required")
+	errs.check(sr.Subscription.Keys.P256dh != "", "subscription.keys.p256dh", "is required")
+	errs.check(sr.Subscription.Keys.Auth != "", "subscription.keys.auth", "is required")
+	if sr.Subscription.Keys.P256dh != "" && sr.Subscription.Keys.Auth != "" {
+		errs.checkErr(push.ValidateKeys(&sr.Subscription.Subscription), "subscription.keys")
+	}
+
+	if sr.Timezone != "" {
+		_, err := time.LoadLocation(sr.Timezone)
+		errs.check(err == nil, "timezone", "is not a known IANA timezone")
+	}
+	if sr.QuietHours != nil {
+		errs.checkErr(sr.QuietHours.Validate(), "quietHours")
+	}
+
+	return errs.err()
+}
+
+// unsubscriptionRequest identifies a subscription by its endpoint, and proves
+// it is the browser's own with its auth secret.
+type unsubscriptionRequest struct {
+	Subscription browserSubscription `json:"subscription"`
+}
+
+func (ur *unsubscriptionRequest) Bind(r *http.Request) error {
+	var errs validationErrors
+
+	errs.check(ur.Subscription.Endpoint != "", "subscription.endpoint", "is required")
+	errs.check(ur.Subscription.Keys.Auth != "", "subscription.keys.auth", "is required")
+
+	return errs.err()
+}
+
+const (
+	// the longest ttl push services accept, 4 weeks
+	maxTTL = 4 * 7 * 24 * 60 * 60
+	// the furthest ahead a notification may be scheduled
+	maxScheduleAhead = 365 * 24 * time.Hour
+	// the longest redirect url, signed links carry it in full
+	maxRedirectLength = 2048
+)
+
+var urgencies = []webpush.Urgency{
+	webpush.UrgencyVeryLow,
+	webpush.UrgencyLow,
+	webpush.UrgencyNormal,
+	webpush.UrgencyHigh,
 }
 
 type notificationRequest struct {
@@ -23,16 +90,184 @@ type notificationRequest struct {
 	push.NotificationOptions
 
 	Scheduled string `json:"scheduled,omitempty"`
+	LocalTime bool   `json:"localTime,omitempty"`
+
+	// payloads tested against each other, overriding the fields above
+	Variants []variantRequest `json:"variants,omitempty"`
+
+	scheduledAt time.Time
+}
+
+type variantRequest struct {
+	push.PushPayload
+
+	ID string `json:"id"`
+	// nil weighs the variant as 1, 0 leaves it out
+	Weight *int `json:"weight,omitempty"`
 }
 
+func (vr *variantRequest) weight() int {
+	if vr.Weight == nil {
+		return 1
+	}
+	return *vr.Weight
+}
+
+const (
+	// the most variants a notification may be split into
+	maxVariants = 10
+	// the largest weight of a variant
+	maxVariantWeight = 1000
+)
+
+var variantIDRegexp = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
 func (nr *notificationRequest) Bind(r *http.Request) error {
+	var errs validationErrors
+
+	errs.check(strings.TrimSpace(nr.Title) != "" || len(nr.Variants) > 0, "title", "is required")
+	errs.check(isURL(nr.Icon), "icon", "must be an absolute http(s) url")
+	errs.check(isURL(nr.Redirect), "redirect", "must be an absolute http(s) url")
+	errs.check(len(nr.Redirect) <= maxRedirectLength, "redirect", fmt.Sprintf("must be at most %d bytes", maxRedirectLength))
+	errs.check(nr.TTL >= 0 && nr.TTL <= maxTTL, "ttl", fmt.Sprintf("must be between 0 and %d seconds", maxTTL))
+	errs.check(nr.Urgency == "" || validUrgency(nr.Urgency), "urgency", "must be one of very-low, low, normal or high")
+
+	if len(nr.Variants) > 0 {
+		errs.check(len(nr.Variants) >= 2 && len(nr.Variants) <= maxVariants, "variants", fmt.Sprintf("must have between 2 and %d variants", maxVariants))
+	}
+	seen := make(map[string]bool, len(nr.Variants))
+	total := 0
+	for i, variant := range nr.Variants {
+		field := fmt.Sprintf("variants[%d]", i)
+		errs.check(variantIDRegexp.MatchString(variant.ID), field+".id", "must be 1 to 32 lowercase letters, digits, - or _")
+		errs.check(!seen[variant.ID], field+".id", "must be unique")
+		errs.check(variant.weight() >= 0 && variant.weight() <= maxVariantWeight, field+".weight", fmt.Sprintf("must be between 0 and %d", maxVariantWeight))
+		errs.check(strings.TrimSpace(variant.Title) != "" || strings.TrimSpace(nr.Title) != "", field+".title", "is required without a title")
+		errs.check(isURL(variant.Icon), field+".icon", "must be an absolute http(s) url")
+		errs.check(isURL(variant.Redirect), field+".redirect", "must be an absolute http(s) url")
+		errs.check(len(variant.Redirect) <= maxRedirectLength, field+".redirect", fmt.Sprintf("must be at most %d bytes", maxRedirectLength))
+		seen[variant.ID] = true
+		total += variant.weight()
+	}
+	if len(nr.Variants) > 0 {
+		errs.check(total > 0, "variants", "must have a variant with a weight above 0")
+	}
+
+	if nr.Scheduled != "" {
+		scheduledAt, err := parseScheduledTime(nr.Scheduled, nr.LocalTime)
+		if err != nil {
+			errs.check(false, "scheduled", "must be an RFC 3339 time")
+		} else {
+			nr.scheduledAt = scheduledAt
+			errs.check(time.Until(scheduledAt) <= maxScheduleAhead, "scheduled", "is too far in the future")
+		}
+	} else {
+		errs.check(!nr.LocalTime, "scheduled", "is required with localTime")
+	}
+
+	return errs.err()
+}
+
+// applyDefaults fills in what the request left out, from the topic first.
+func (nr *notificationRequest) applyDefaults(defaults push.TopicDefaults) {
+	if nr.Urgency == "" {
+		nr.Urgency = defaults.Urgency
+	}
 	if nr.Urgency == "" {
 		nr.Urgency = webpush.UrgencyNormal
 	}
+	if nr.TTL == 0 {
+		nr.TTL = defaults.TTL
+	}
 	if nr.TTL == 0 {
 		nr.TTL = 30
 	}
-	return nil
+	if nr.Icon == "" {
+		nr.Icon = defaults.Icon
+	}
+}
+
+// variants fills in the fields each variant left out from the payload, and
+// weighs variants without a weight as 1. Variants weighed 0 are kept, so
+// they show in the analytics, but never sent.
+func (nr *notificationRequest) variants(payload push.PushPayload) []push.Variant {
+	if len(nr.Variants) == 0 {
+		return nil
+	}
+
+	variants := make([]push.Variant, 0, len(nr.Variants))
+	for _, v := range nr.Variants {
+		variant := push.Variant{ID: v.ID, Weight: v.weight(), PushPayload: payload}
+		if v.Title != "" {
+			variant.Title = v.Title
+		}
+		if v.Body != "" {
+			variant.Body = v.Body
+		}
+		if v.Icon != "" {
+			variant.Icon = v.Icon
+		}
+		if v.Redirect != "" {
+			variant.Redirect = v.Redirect
+		}
+		variants = append(variants, variant)
+	}
+	return variants
+}
+
+type topicRequest struct {
+	// only read when creating a topic
+	ID string `json:"id,omitempty"`
+
+	Name        string             `json:"name,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Owner       string             `json:"owner,omitempty"`
+	Defaults    push.TopicDefaults `json:"defaults"`
+	Replay      push.ReplayOptions `json:"replay"`
+	Archived    bool               `json:"archived,omitempty"`
+}
+
+type vapidKeysRequest struct {
+	push.VapidKeys
+}
+
+func (vr *vapidKeysRequest) Bind(r *http.Request) error {
+	var errs validationErrors
+	errs.checkErr(push.ValidateVapidKeys(vr.VapidKeys), "vapidPrivateKey")
+	return errs.err()
+}
+
+// the most notifications replayed to a new subscriber
+const maxReplayCount = 20
+
+func (tr *topicRequest) Bind(r *http.Request) error {
+	var errs validationErrors
+
+	errs.check(len(tr.Name) <= 100, "name", "must be at most 100 characters")
+	errs.check(len(tr.Description) <= 1000, "description", "must be at most 1000 characters")
+	errs.check(tr.Defaults.TTL >= 0 && tr.Defaults.TTL <= maxTTL, "defaults.ttl", fmt.Sprintf("must be between 0 and %d seconds", maxTTL))
+	errs.check(tr.Defaults.Urgency == "" || validUrgency(tr.Defaults.Urgency), "defaults.urgency", "must be one of very-low, low, normal or high")
+	errs.check(isURL(tr.Defaults.Icon), "defaults.icon", "must be an absolute http(s) url")
+	errs.check(tr.Replay.Count >= 0 && tr.Replay.Count <= maxReplayCount, "replay.count", fmt.Sprintf("must be between 0 and %d", maxReplayCount))
+	errs.check(tr.Replay.MaxAge >= 0, "replay.maxAge", "must not be negative")
+
+	return errs.err()
+}
+
+func validUrgency(urgency webpush.Urgency) bool {
+	for _, u := range urgencies {
+		if urgency == u {
+			return true
+		}
+	}
+	return false
+}
+
+// idempotencyRecord is stored for each Idempotency-Key to replay the response.
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	ID          string `json:"id"`
+	Message     string `json:"message"`
 }
 
 // responses
@@ -56,19 +291,88 @@ func newSuccessResponse(message string) *response {
 	}
 }
 
+type ErrorCode string
+
+const (
+	ErrorCodeBadRequest      ErrorCode = "bad_request"
+	ErrorCodeUnauthorized    ErrorCode = "unauthorized"
+	ErrorCodeNotFound        ErrorCode = "not_found"
+	ErrorCodeMethod          ErrorCode = "method_not_allowed"
+	ErrorCodeConflict        ErrorCode = "conflict"
+	ErrorCodePayloadTooLarge ErrorCode = "payload_too_large"
+	ErrorCodeRateLimited     ErrorCode = "rate_limited"
+	ErrorCodeInternal        ErrorCode = "internal"
+)
+
 type errorResponse struct {
 	response
+	Code      ErrorCode   `json:"code"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+
+	HTTPStatus int `json:"-"`
 }
 
-func newErrorResponse(message string) *errorResponse {
+func (e *errorResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	e.RequestID = middleware.GetReqID(r.Context())
+	render.Status(r, e.HTTPStatus)
+	return nil
+}
+
+func newErrorResponse(httpStatus int, code ErrorCode, message string) *errorResponse {
 	return &errorResponse{
 		response: response{
 			Status:  ResponseTypeError,
 			Message: message,
 		},
+		Code:       code,
+		HTTPStatus: httpStatus,
 	}
 }
 
+func errBadRequest(message string) *errorResponse {
+	return newErrorResponse(http.StatusBadRequest, ErrorCodeBadRequest, message)
+}
+
+// errBind reports a request body that could not be decoded or validated.
+func errBind(err error) *errorResponse {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return newErrorResponse(http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge, "request body too large")
+	}
+
+	var validationErr validationErrors
+	if errors.As(err, &validationErr) {
+		resp := errBadRequest("invalid request")
+		resp.Details = validationErr
+		return resp
+	}
+
+	return errBadRequest(fmt.Sprintf("failed to bind request: %v", err))
+}
+
+func errUnauthorized(message string) *errorResponse {
+	return newErrorResponse(http.StatusUnauthorized, ErrorCodeUnauthorized, message)
+}
+
+func errNotFound(message string) *errorResponse {
+	return newErrorResponse(http.StatusNotFound, ErrorCodeNotFound, message)
+}
+
+func errConflict(message string) *errorResponse {
+	return newErrorResponse(http.StatusConflict, ErrorCodeConflict, message)
+}
+
+func errRateLimited() *errorResponse {
+	return newErrorResponse(http.StatusTooManyRequests, ErrorCodeRateLimited, "rate limit exceeded")
+}
+
+// errInternal logs the underlying error, which is not shown to clients.
+func errInternal(message string, err error) *errorResponse {
+	log.Printf("[ERROR] %s: %v", message, err)
+	return newErrorResponse(http.StatusInternalServerError, ErrorCodeInternal, message)
+}
+
 type vapidKeyResponse struct {
 	response
 	Key string `json:"key"`
@@ -83,6 +387,21 @@ func newVapidKeyResponse(vapidKeys push.VapidKeys) *vapidKeyResponse {
 	}
 }
 
+type subscriptionResponse struct {
+	response
+	ID string `json:"id"`
+}
+
+func newSubscriptionResponse(id, message string) *subscriptionResponse {
+	return &subscriptionResponse{
+		response: response{
+			Status:  ResponseTypeSuccess,
+			Message: message,
+		},
+		ID: id,
+	}
+}
+
 type notificationResponse struct {
 	response
 	ID string `json:"id"`
@@ -100,37 +419,218 @@ func newNotificationResponse(id, message string) *notificationResponse {
 
 type topicResponse struct {
 	response
-	Subscriptions []push.Subscription `json:"subscriptions"`
+	Topic             push.Topic `json:"topic"`
+	SubscriptionCount int        `json:"subscriptionCount"`
 }
 
-func newTopicResponse(subscriptions []push.Subscription) *topicResponse {
+func newTopicResponse(topic push.Topic, subscriptionCount int) *topicResponse {
 	return &topicResponse{
 		response: response{
 			Status: ResponseTypeSuccess,
 		},
-		Subscriptions: subscriptions,
+		Topic:             topic,
+		SubscriptionCount: subscriptionCount,
 	}
 }
 
-type jobStatus struct {
-	Tags      []string `json:"tags"`
-	StartTime string   `json:"startTime"`
-}
-
 type statusResponse struct {
 	response
-	Jobs          []jobStatus         `json:"jobs"`
-	Notifications []push.Notification `json:"notifications"`
-	Subscriptions []push.Subscription `json:"subscriptions"`
+	Jobs          int `json:"jobs"`
+	Topics        int `json:"topics"`
+	Notifications int `json:"notifications"`
+	Subscriptions int `json:"subscriptions"`
+	// subscriptions by push service host
+	PushServices map[string]int `json:"pushServices"`
+	// when the next pending notification is due
+	NextDue *time.Time `json:"nextDue,omitempty"`
 }
 
-func newStatusResponse(jobs []jobStatus, notifications []push.Notification, subscriptions []push.Subscription) *statusResponse {
+func newStatusResponse(jobs, topics, notifications, subscriptions int, pushServices map[string]int) *statusResponse {
 	return &statusResponse{
 		response: response{
 			Status: ResponseTypeSuccess,
 		},
 		Jobs:          jobs,
+		Topics:        topics,
 		Notifications: notifications,
 		Subscriptions: subscriptions,
+		PushServices:  pushServices,
+	}
+}
+
+type topicSummary struct {
+	push.Topic
+	Subscriptions int `json:"subscriptions"`
+}
+
+type topicsResponse struct {
+	response
+	Topics []topicSummary `json:"topics"`
+	Next   string         `json:"next,omitempty"`
+}
+
+func newTopicsResponse(topics []topicSummary, next string) *topicsResponse {
+	return &topicsResponse{
+		response: response{
+			Status: ResponseTypeSuccess,
+		},
+		Topics: topics,
+		Next:   next,
+	}
+}
+
+// subscriptionSummary is a subscription as listed, without the keys its
+// pushes are encrypted with.
+type subscriptionSummary struct {
+	push.Subscription
+	// hides the keys, the shallower field wins when encoding
+	Keys *struct{} `json:"keys,omitempty"`
+}
+
+type subscriptionsResponse struct {
+	response
+	Subscriptions []subscriptionSummary `json:"subscriptions"`
+	Total         int                   `json:"total"`
+	Next          string                `json:"next,omitempty"`
+}
+
+func newSubscriptionsResponse(subscriptions []push.Subscription, total int, next string) *subscriptionsResponse {
+	summaries := make([]subscriptionSummary, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		summaries = append(summaries, subscriptionSummary{Subscription: subscription})
+	}
+	return &subscriptionsResponse{
+		response: response{
+			Status: ResponseTypeSuccess,
+		},
+		Subscriptions: summaries,
+		Total:         total,
+		Next:          next,
+	}
+}
+
+type notificationsResponse struct {
+	response
+	Notifications []push.Notification `json:"notifications"`
+	Total         int                 `json:"total"`
+	Next          string              `json:"next,omitempty"`
+}
+
+func newNotificationsResponse(notifications []push.Notification, total int, next string) *notificationsResponse {
+	return &notificationsResponse{
+		response: response{
+			Status: ResponseTypeSuccess,
+		},
+		Notifications: notifications,
+		Total:         total,
+		Next:          next,
+	}
+}
+
+type janitorResponse struct {
+	response
+	DryRun        bool                `json:"dryRun"`
+	Subscriptions []staleSubscription `json:"subscriptions"`
+}
+
+func newJanitorResponse(stale []staleSubscription, dryRun bool) *janitorResponse {
+	return &janitorResponse{
+		response: response{
+			Status: ResponseTypeSuccess,
+		},
+		DryRun:        dryRun,
+		Subscriptions: stale,
+	}
+}
+
+// funnel reports the share of deliveries that were displayed and the share
+// of displays that were clicked.
+type funnel struct {
+	Funnel      push.Stats `json:"funnel"`
+	DisplayRate float64    `json:"displayRate"`
+	ClickRate   float64    `json:"clickRate"`
+}
+
+func newFunnel(stats push.Stats) funnel {
+	return funnel{
+		Funnel:      stats,
+		DisplayRate: rate(stats[push.EventDisplayed], stats[push.EventDelivered]),
+		ClickRate:   rate(stats[push.EventClicked], stats[push.EventDisplayed]),
+	}
+}
+
+type variantFunnel struct {
+	ID string `json:"id"`
+	funnel
+}
+
+type analyticsResponse struct {
+	response
+	Topic        string `json:"topic"`
+	Notification string `json:"notification,omitempty"`
+	funnel
+	Variants []variantFunnel `json:"variants,omitempty"`
+}
+
+func newAnalyticsResponse(topic, notification string, stats push.Stats, variants []variantFunnel) *analyticsResponse {
+	return &analyticsResponse{
+		response: response{
+			Status: ResponseTypeSuccess,
+		},
+		Topic:        topic,
+		Notification: notification,
+		funnel:       newFunnel(stats),
+		Variants:     variants,
+	}
+}
+
+func rate(count, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
+
+type importResponse struct {
+	response
+	store.ImportResult
+}
+
+func newImportResponse(result store.ImportResult) *importResponse {
+	return &importResponse{
+		response: response{
+			Status: ResponseTypeSuccess,
+		},
+		ImportResult: result,
+	}
+}
+
+type bulkImportResponse struct {
+	response
+	SubscriptionImportResult
+}
+
+func newBulkImportResponse(result SubscriptionImportResult) *bulkImportResponse {
+	return &bulkImportResponse{
+		response: response{
+			Status: ResponseTypeSuccess,
+		},
+		SubscriptionImportResult: result,
+	}
+}
+
+type quarantineResponse struct {
+	response
+	SchemaVersion int                 `json:"schemaVersion"`
+	Records       []store.Quarantined `json:"records"`
+}
+
+func newQuarantineResponse(version int, records []store.Quarantined) *quarantineResponse {
+	return &quarantineResponse{
+		response: response{
+			Status: ResponseTypeSuccess,
+		},
+		SchemaVersion: version,
+		Records:       records,
 	}
 }
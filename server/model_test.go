@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+func TestNotificationRequestVariants(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		valid   bool
+		weights []int
+	}{
+		{
+			name:    "weights default to 1",
+			body:    `{"title":"t","variants":[{"id":"a"},{"id":"b","weight":3}]}`,
+			valid:   true,
+			weights: []int{1, 3},
+		},
+		{
+			name:    "weight 0 leaves a variant out",
+			body:    `{"title":"t","variants":[{"id":"a","weight":0},{"id":"b"}]}`,
+			valid:   true,
+			weights: []int{0, 1},
+		},
+		{
+			name: "every variant weighed 0",
+			body: `{"title":"t","variants":[{"id":"a","weight":0},{"id":"b","weight":0}]}`,
+		},
+		{
+			name: "negative weight",
+			body: `{"title":"t","variants":[{"id":"a","weight":-1},{"id":"b"}]}`,
+		},
+		{
+			name: "weight too large",
+			body: `{"title":"t","variants":[{"id":"a","weight":1001},{"id":"b"}]}`,
+		},
+		{
+			name: "duplicate ids",
+			body: `{"title":"t","variants":[{"id":"a"},{"id":"a"}]}`,
+		},
+		{
+			name: "a single variant",
+			body: `{"title":"t","variants":[{"id":"a"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nr := &notificationRequest{}
+			if err := json.Unmarshal([]byte(tt.body), nr); err != nil {
+				t.Fatal(err)
+			}
+			err := nr.Bind(httptest.NewRequest("POST", "/", nil))
+			if (err == nil) != tt.valid {
+				t.Fatalf("Bind: got %v, want valid %v", err, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+
+			variants := nr.variants(push.PushPayload{Title: "t"})
+			if len(variants) != len(tt.weights) {
+				t.Fatalf("got %d variants, want %d", len(variants), len(tt.weights))
+			}
+			for i, variant := range variants {
+				if variant.Weight != tt.weights[i] {
+					t.Errorf("variant %s: got weight %d, want %d", variant.ID, variant.Weight, tt.weights[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNotificationRequestRedirect(t *testing.T) {
+	long := "https://example.com/" + strings.Repeat("a", maxRedirectLength)
+	tests := []struct {
+		name  string
+		body  string
+		valid bool
+	}{
+		{name: "redirect", body: `{"title":"t","redirect":"https://example.com/a"}`, valid: true},
+		{name: "relative redirect", body: `{"title":"t","redirect":"/a"}`},
+		{name: "long redirect", body: `{"title":"t","redirect":"` + long + `"}`},
+		{name: "long variant redirect", body: `{"title":"t","variants":[{"id":"a","redirect":"` + long + `"},{"id":"b"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nr := &notificationRequest{}
+			if err := json.Unmarshal([]byte(tt.body), nr); err != nil {
+				t.Fatal(err)
+			}
+			err := nr.Bind(httptest.NewRequest("POST", "/", nil))
+			if (err == nil) != tt.valid {
+				t.Fatalf("Bind: got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// matches the pattern of a chi route parameter, "{id:[a-z]+}" is "{id}" in the spec
+var routeParamPattern = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+func specPath(route string) string {
+	path := routeParamPattern.ReplaceAllString(route, "{$1}")
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+func TestOpenAPIMatchesRouter(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, Config{})
+	routes := make(map[string]bool)
+	err := chi.Walk(s.newRouter(), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		path := specPath(route)
+		if path == "/" {
+			// hello world
+			return nil
+		}
+		routes[strings.ToLower(method)+" "+path] = true
+		if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+			t.Errorf("%s %s is missing from openapi.json", method, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if method != "parameters" && !routes[method+" "+path] {
+				t.Errorf("%s %s of openapi.json has no route", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
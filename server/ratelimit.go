@@ -0,0 +1,191 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const rateLimitTag = "job:ratelimit"
+
+// rateLimiter allows a number of events per key within a sliding window.
+// Events may be reserved in the future, which is how queued notifications
+// keep their place.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// next returns the earliest time at which another event fits for the key.
+func (l *rateLimiter) next(key string, now time.Time) time.Time {
+	if l == nil || l.limit <= 0 {
+		return now
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.prune(key, now)
+	if len(events) < l.limit {
+		return now
+	}
+
+	at := events[len(events)-l.limit].Add(l.window)
+	if at.Before(now) {
+		return now
+	}
+	return at
+}
+
+// record counts an event for the key at the given time.
+func (l *rateLimiter) record(key string, at time.Time) {
+	if l == nil || l.limit <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.events[key]
+	i := sort.Search(len(events), func(i int) bool { return events[i].After(at) })
+	events = append(events, time.Time{})
+	copy(events[i+1:], events[i:])
+	events[i] = at
+	l.events[key] = events
+}
+
+// sweep drops the keys without events left in the window, which prune only
+// does for the keys still in use.
+func (l *rateLimiter) sweep(now time.Time) {
+	if l == nil || l.limit <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key := range l.events {
+		l.prune(key, now)
+	}
+}
+
+func (l *rateLimiter) prune(key string, now time.Time) []time.Time {
+	events := l.events[key]
+
+	cutoff := now.Add(-l.window)
+	i := sort.Search(len(events), func(i int) bool { return events[i].After(cutoff) })
+	events = events[i:]
+
+	if len(events) == 0 {
+		delete(l.events, key)
+	} else {
+		l.events[key] = events
+	}
+	return events
+}
+
+// tokenBucket limits the rate of requests per key, allowing short bursts.
+type tokenBucket struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perMinute int) *tokenBucket {
+	return &tokenBucket{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token for the key, returning how long to wait if there is none.
+func (tb *tokenBucket) allow(key string, now time.Time) (bool, time.Duration) {
+	if tb == nil || tb.rate <= 0 {
+		return true, 0
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.sweep(now)
+
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &bucket{tokens: tb.burst, last: now}
+		tb.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * tb.rate
+	if b.tokens > tb.burst {
+		b.tokens = tb.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / tb.rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweepIdle sweeps the buckets of keys that stopped making requests.
+func (tb *tokenBucket) sweepIdle(now time.Time) {
+	if tb == nil || tb.rate <= 0 {
+		return
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.sweep(now)
+}
+
+// sweep drops buckets that have refilled completely, they behave like new ones.
+func (tb *tokenBucket) sweep(now time.Time) {
+	if now.Sub(tb.lastSweep) < time.Minute {
+		return
+	}
+	tb.lastSweep = now
+
+	full := time.Duration(tb.burst / tb.rate * float64(time.Second))
+	for key, b := range tb.buckets {
+		if now.Sub(b.last) > full {
+			delete(tb.buckets, key)
+		}
+	}
+}
+
+// startRateLimitSweep drops the keys of the limiters once a window, so
+// clients that stop making requests don't keep memory.
+func (s *Server) startRateLimitSweep() {
+	if s.config.RateLimitWindow <= 0 {
+		return
+	}
+
+	s.scheduler.scheduleEvery(s.config.RateLimitWindow, rateLimitTag, func() {
+		now := time.Now()
+		s.topicLimiter.sweep(now)
+		s.apiKeyLimiter.sweep(now)
+		s.subscribeLimiter.sweepIdle(now)
+	})
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2, time.Minute)
+
+	steps := []struct {
+		at   time.Duration
+		want time.Duration
+	}{
+		{0, 0},
+		{10 * time.Second, 10 * time.Second},
+		// full until the first event leaves the window
+		{20 * time.Second, time.Minute},
+		{time.Minute, 70 * time.Second},
+		{65 * time.Second, 2 * time.Minute},
+	}
+	for _, step := range steps {
+		now := start.Add(step.at)
+		next := l.next("k", now)
+		if want := start.Add(step.want); !next.Equal(want) {
+			t.Fatalf("at %v: got next %v, want %v", step.at, next.Sub(start), step.want)
+		}
+		l.record("k", next)
+	}
+
+	if next := l.next("other", start); !next.Equal(start) {
+		t.Errorf("other key: got next %v, want now", next.Sub(start))
+	}
+	if next := newRateLimiter(0, time.Minute).next("k", start); !next.Equal(start) {
+		t.Errorf("disabled limiter: got next %v, want now", next.Sub(start))
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tb := newTokenBucket(2)
+
+	steps := []struct {
+		at    time.Duration
+		allow bool
+	}{
+		{0, true},
+		{0, true},
+		{time.Second, false},
+		// a token every 30s
+		{30 * time.Second, true},
+		{31 * time.Second, false},
+	}
+	for _, step := range steps {
+		if allowed, _ := tb.allow("ip", start.Add(step.at)); allowed != step.allow {
+			t.Fatalf("at %v: got allowed %v, want %v", step.at, allowed, step.allow)
+		}
+	}
+	if allowed, _ := tb.allow("other", start.Add(31*time.Second)); !allowed {
+		t.Error("other key: got denied")
+	}
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2, time.Minute)
+	l.record("idle", start)
+	l.record("active", start.Add(50*time.Second))
+	// queued notifications reserve events ahead
+	l.record("reserved", start.Add(5*time.Minute))
+
+	l.sweep(start.Add(90 * time.Second))
+	if _, ok := l.events["idle"]; ok || len(l.events) != 2 {
+		t.Errorf("got keys %v, want the idle one dropped", l.events)
+	}
+	l.sweep(start.Add(10 * time.Minute))
+	if len(l.events) != 0 {
+		t.Errorf("got keys %v, want none", l.events)
+	}
+	newRateLimiter(0, time.Minute).sweep(start)
+
+	tb := newTokenBucket(2)
+	tb.allow("idle", start)
+	tb.allow("active", start.Add(50*time.Second))
+	tb.sweepIdle(start.Add(70 * time.Second))
+	if _, ok := tb.buckets["idle"]; ok || len(tb.buckets) != 1 {
+		t.Errorf("got buckets %v, want the idle one dropped", tb.buckets)
+	}
+}
+
+func TestPushRateLimits(t *testing.T) {
+	tomorrow := time.Now().Add(24 * time.Hour).Format("2006-01-02T15:04:05")
+	localTime := map[string]interface{}{"title": "hi", "scheduled": tomorrow, "localTime": true}
+	now := map[string]interface{}{"title": "hi"}
+	key := func(k string) http.Header { return http.Header{"X-Api-Key": {k}} }
+
+	type request struct {
+		topic   string
+		header  http.Header
+		body    map[string]interface{}
+		status  int
+		message string
+	}
+	tests := []struct {
+		name     string
+		config   Config
+		requests []request
+	}{
+		{
+			name:   "topic limit",
+			config: Config{TopicRateLimit: 1},
+			requests: []request{
+				{"news", nil, now, http.StatusOK, "notification sent"},
+				{"news", nil, now, http.StatusTooManyRequests, ""},
+				{"sports", nil, now, http.StatusOK, "notification sent"},
+			},
+		},
+		{
+			name:   "queued topic limit",
+			config: Config{TopicRateLimit: 1, RateLimitQueue: true},
+			requests: []request{
+				{"news", nil, now, http.StatusOK, "notification sent"},
+				{"news", nil, now, http.StatusOK, "notification queued"},
+				{"news", nil, localTime, http.StatusTooManyRequests, ""},
+			},
+		},
+		{
+			name:   "unconfigured api keys are not limited",
+			config: Config{APIKeyRateLimit: 1},
+			requests: []request{
+				{"news", key("a"), now, http.StatusOK, "notification sent"},
+				{"sports", key("a"), now, http.StatusOK, "notification sent"},
+			},
+		},
+		{
+			name:   "api keys",
+			config: Config{APIKeys: []string{"a", "b"}, APIKeyRateLimit: 1, RateLimitQueue: true},
+			requests: []request{
+				{"news", nil, now, http.StatusUnauthorized, ""},
+				{"news", key("c"), now, http.StatusUnauthorized, ""},
+				{"news", key("a"), now, http.StatusOK, "notification sent"},
+				{"sports", key("a"), localTime, http.StatusTooManyRequests, ""},
+				{"sports", key("a"), now, http.StatusOK, "notification queued"},
+				{"sports", key("b"), now, http.StatusOK, "notification sent"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.config)
+			for i, req := range tt.requests {
+				var resp struct {
+					Message string `json:"message"`
+				}
+				rec := serve(t, s, http.MethodPost, "/api/topic/"+req.topic+"/push", req.header, req.body, &resp)
+				if rec.Code != req.status {
+					t.Fatalf("request %d: got status %d, want %d: %s", i, rec.Code, req.status, rec.Body.String())
+				}
+				if req.message != "" && resp.Message != req.message {
+					t.Errorf("request %d: got %q, want %q", i, resp.Message, req.message)
+				}
+				if req.status == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d: no Retry-After", i)
+				}
+			}
+		})
+	}
+}
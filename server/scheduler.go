@@ -32,6 +32,14 @@ func (s *scheduler) scheduleAt(t time.Time, topic string, job func()) {
 	}
 }
 
+// scheduleEvery runs a recurring job, the first run happening after one interval.
+func (s *scheduler) scheduleEvery(interval time.Duration, tag string, job func()) {
+	_, err := s.Scheduler.Every(interval).WaitForSchedule().SingletonMode().Tag(tag).Do(job)
+	if err != nil {
+		log.Printf("[ERROR] Failed to schedule job: %v", err)
+	}
+}
+
 // func (s *scheduler) scheduleCron(cron string, job func()) {
 // 	s.Scheduler.Cron(cron).Do(job)
 // }
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	"github.com/go-chi/render"
+)
+
+// sdkVersion is bumped with every change to the scripts in sdk/.
+const sdkVersion = "1.2.0"
+
+//go:embed sdk/*.js
+var sdkFS embed.FS
+
+var sdkTemplates = template.Must(template.ParseFS(sdkFS, "sdk/*.js"))
+
+// sdkPayloadFields tells the service worker what to do with each field of a
+// push.PushPayload: "title" is the notification title, "option" is passed to
+// showNotification, and "data" is kept for handling clicks and tracking.
+var sdkPayloadFields = map[string]string{
+	"title":    "title",
+	"body":     "option",
+	"icon":     "option",
+	"redirect": "data",
+	"id":       "data",
+	"topic":    "data",
+	"variant":  "data",
+	"track":    "data",
+}
+
+// payloadFields lists the json names of the fields of a push payload, so
+// that a field added to push.PushPayload can't be missed by the SDK.
+func payloadFields() []string {
+	t := reflect.TypeOf(push.PushPayload{})
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// sdkFields encodes sdkPayloadFields for the scripts, and fails on fields
+// of push.PushPayload it misses.
+func sdkFields() (string, error) {
+	fields := make(map[string]string)
+	for _, name := range payloadFields() {
+		use, ok := sdkPayloadFields[name]
+		if !ok {
+			return "", fmt.Errorf("payload field %q is not handled by the SDK", name)
+		}
+		fields[name] = use
+	}
+
+	data, err := json.Marshal(fields)
+	return string(data), err
+}
+
+type sdkData struct {
+	Version string
+	// json encoded, ready to be used in the scripts
+	APIURL string
+	Fields string
+}
+
+// apiURL is where scripts loaded from other origins reach the API.
+func (s *Server) apiURL(r *http.Request) string {
+	if s.config.PublicURL != "" {
+		return strings.TrimSuffix(s.config.PublicURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// serveSDK renders one of the SDK scripts for the API's URL.
+func (s *Server) serveSDK(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiURL, _ := json.Marshal(s.apiURL(r))
+
+		var buf bytes.Buffer
+		data := sdkData{Version: sdkVersion, APIURL: string(apiURL), Fields: s.sdkFields}
+		if err := sdkTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+			render.Render(w, r, errInternal("failed to render sdk", err))
+			return
+		}
+
+		sum := sha256.Sum256(buf.Bytes())
+		etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-SDK-Version", sdkVersion)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(buf.Bytes())
+	}
+}
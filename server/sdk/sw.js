@@ -0,0 +1,72 @@
+// webpush-api service worker {{.Version}}, served by the API at /sdk/sw.js.
+// Load it from your own service worker with importScripts.
+(function () {
+  "use strict";
+
+  const API_URL = {{.APIURL}};
+
+  // how each field of a push payload is used, generated from the API's types
+  const FIELDS = {{.Fields}};
+
+  function track(data, event) {
+    if (!data.track) {
+      return Promise.resolve();
+    }
+    const url = API_URL + "/api/track/" + encodeURIComponent(data.track) + "/" + event;
+    return fetch(url, { method: "POST" }).catch(() => {});
+  }
+
+  self.addEventListener("push", (event) => {
+    let payload;
+    try {
+      payload = event.data.json();
+    } catch (e) {
+      return;
+    }
+
+    // subscriptions are verified with a push, which browsers require to be
+    // shown like any other, as a confirmation of the subscription
+    if (payload.type === "verify") {
+      event.waitUntil(self.registration.showNotification(payload.title, { tag: "webpush-verify" }));
+      return;
+    }
+
+    let title = "";
+    const options = { data: {} };
+    for (const [name, use] of Object.entries(FIELDS)) {
+      if (payload[name] === undefined) {
+        continue;
+      }
+      if (use === "title") {
+        title = payload[name];
+      } else if (use === "option") {
+        options[name] = payload[name];
+      } else {
+        options.data[name] = payload[name];
+      }
+    }
+
+    event.waitUntil(
+      self.registration.showNotification(title, options).then(() => track(options.data, "display"))
+    );
+  });
+
+  self.addEventListener("notificationclick", (event) => {
+    const data = event.notification.data || {};
+    event.notification.close();
+
+    // tracked redirect links count the click themselves
+    const tracked = data.redirect && data.redirect.startsWith(API_URL + "/r/");
+
+    event.waitUntil(
+      Promise.all([
+        tracked ? Promise.resolve() : track(data, "click"),
+        data.redirect ? self.clients.openWindow(data.redirect) : Promise.resolve(),
+      ])
+    );
+  });
+
+  self.addEventListener("notificationclose", (event) => {
+    event.waitUntil(track(event.notification.data || {}, "close"));
+  });
+})();
@@ -0,0 +1,103 @@
+// webpush-api browser SDK {{.Version}}, served by the API at /sdk/webpush.js.
+(function (global) {
+  "use strict";
+
+  const API_URL = {{.APIURL}};
+
+  function urlBase64ToUint8Array(value) {
+    const padding = "=".repeat((4 - (value.length % 4)) % 4);
+    const raw = atob((value + padding).replace(/-/g, "+").replace(/_/g, "/"));
+    return Uint8Array.from(raw, (c) => c.charCodeAt(0));
+  }
+
+  async function request(method, path, body) {
+    const res = await fetch(API_URL + path, {
+      method,
+      headers: body ? { "Content-Type": "application/json" } : {},
+      body: body ? JSON.stringify(body) : undefined,
+    });
+    const data = await res.json();
+    if (!res.ok) {
+      const err = new Error(data.message || res.statusText);
+      err.code = data.code;
+      err.details = data.details;
+      throw err;
+    }
+    return data;
+  }
+
+  // topicPath escapes the topic, keeping the ".*" of wildcard topics as is.
+  function topicPath(topic, suffix) {
+    let wildcard = "";
+    if (topic.endsWith(".*")) {
+      topic = topic.slice(0, -2);
+      wildcard = ".*";
+    }
+    return "/api/topic/" + encodeURIComponent(topic) + wildcard + suffix;
+  }
+
+  async function registration(options) {
+    if (options && options.registration) {
+      return options.registration;
+    }
+    return navigator.serviceWorker.ready;
+  }
+
+  const WebPush = {
+    version: {{.Version | printf "%q"}},
+    apiUrl: API_URL,
+
+    // supported reports whether the browser can receive push notifications.
+    supported() {
+      return "serviceWorker" in navigator && "PushManager" in global;
+    },
+
+    // subscribe asks for permission and subscribes the browser to a topic.
+    // options: registration, timezone, quietHours ({ start, end }).
+    async subscribe(topic, options = {}) {
+      const reg = await registration(options);
+
+      let subscription = await reg.pushManager.getSubscription();
+      if (!subscription) {
+        const { key } = await request("GET", "/api/vapid");
+        subscription = await reg.pushManager.subscribe({
+          userVisibleOnly: true,
+          applicationServerKey: urlBase64ToUint8Array(key),
+        });
+      }
+
+      return request("POST", topicPath(topic, "/subscribe"), {
+        subscription: subscription.toJSON(),
+        timezone: options.timezone || Intl.DateTimeFormat().resolvedOptions().timeZone,
+        quietHours: options.quietHours,
+      });
+    },
+
+    // unsubscribe removes the browser's subscription to a topic from the API,
+    // keeping its push subscription for other topics. Without a topic, it
+    // removes the push subscription itself, and the API prunes the topics
+    // it was subscribed to once the push service rejects it.
+    async unsubscribe(topic, options = {}) {
+      if (typeof topic !== "string") {
+        options = topic || {};
+        topic = undefined;
+      }
+
+      const reg = await registration(options);
+      const subscription = await reg.pushManager.getSubscription();
+      if (!subscription) {
+        return false;
+      }
+      if (topic === undefined) {
+        return subscription.unsubscribe();
+      }
+
+      const { endpoint, keys } = subscription.toJSON();
+      return request("POST", topicPath(topic, "/unsubscribe"), {
+        subscription: { endpoint, keys: { auth: keys.auth } },
+      });
+    },
+  };
+
+  global.WebPush = WebPush;
+})(typeof self !== "undefined" ? self : this);
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSDKFields(t *testing.T) {
+	data, err := sdkFields()
+	if err != nil {
+		t.Fatalf("sdkFields: %v", err)
+	}
+
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range payloadFields() {
+		switch fields[name] {
+		case "title", "option", "data":
+		default:
+			t.Errorf("payload field %q: got use %q", name, fields[name])
+		}
+	}
+}
+
+func TestServeSDK(t *testing.T) {
+	s := newTestServer(t, Config{PublicURL: "https://push.example.com/"})
+
+	for _, name := range []string{"webpush.js", "sw.js"} {
+		w := serve(t, s, "GET", "/sdk/"+name, nil, nil, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", name, w.Code)
+		}
+		if got := w.Header().Get("X-SDK-Version"); got != sdkVersion {
+			t.Errorf("%s: got version %q, want %q", name, got, sdkVersion)
+		}
+
+		etag := w.Header().Get("ETag")
+		w = serve(t, s, "GET", "/sdk/"+name, http.Header{"If-None-Match": {etag}}, nil, nil)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("%s: got status %d with the etag, want 304", name, w.Code)
+		}
+	}
+
+	w := serve(t, s, "GET", "/sdk/sw.js", nil, nil, nil)
+	if !strings.Contains(w.Body.String(), s.sdkFields) {
+		t.Errorf("sw.js doesn't embed the payload fields %s", s.sdkFields)
+	}
+}
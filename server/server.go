@@ -13,15 +13,24 @@ import (
 )
 
 type Server struct {
+	config    Config
 	server    *http.Server
 	store     *store.Store
 	push      *push.WebPush
 	scheduler *scheduler
 	shutdown  bool
 	notifs    chan *push.Notification
+	links     *linkSigner
+	tracking  *linkSigner
+	// json encoded sdkPayloadFields, built once
+	sdkFields string
+
+	topicLimiter     *rateLimiter
+	apiKeyLimiter    *rateLimiter
+	subscribeLimiter *tokenBucket
 }
 
-func NewServer(addr string, store *store.Store) (s *Server) {
+func NewServer(config Config, store *store.Store) (s *Server) {
 	// init vapid keys
 	vapidKeys, err := store.GetVapidKeys()
 	if err != nil {
@@ -33,28 +42,61 @@ func NewServer(addr string, store *store.Store) (s *Server) {
 		log.Printf("[INFO] Generated VAPID keys: %+v", vapidKeys)
 	}
 
+	// the sdk must handle every payload field
+	sdkFields, err := sdkFields()
+	if err != nil {
+		log.Fatal("[ERROR] Failed to build SDK: ", err)
+	}
+
+	if config.APIKeyRateLimit > 0 && len(config.APIKeys) == 0 {
+		log.Printf("[INFO] API key rate limit disabled, it needs API keys to be configured")
+	}
+
 	// init webpush
 	wp := push.NewWebPush(vapidKeys.VAPIDPublicKey, vapidKeys.VAPIDPrivateKey)
+	wp.SetHostRate(config.PushHostRate)
+
+	// key pairs of subscriptions imported from other push vendors
+	keyPairs, err := store.GetVapidKeyPairs()
+	if err != nil {
+		log.Fatal("[ERROR] Failed to get VAPID key pairs: ", err)
+	}
+	for _, keys := range keyPairs {
+		wp.AddVapidKeys(keys)
+	}
 
 	// init scheduler
 	scheduler := startScheduler()
 
+	links := newLinkSigner(store)
+
 	s = &Server{
+		config:    config,
 		server:    nil,
 		store:     store,
 		push:      wp,
 		scheduler: scheduler,
 		shutdown:  false,
 		notifs:    make(chan *push.Notification, 256),
+		links:     links,
+		tracking:  links.derive("track"),
+		sdkFields: sdkFields,
+
+		topicLimiter:  newRateLimiter(config.TopicRateLimit, config.RateLimitWindow),
+		apiKeyLimiter: newRateLimiter(config.APIKeyRateLimit, config.RateLimitWindow),
+
+		subscribeLimiter: newTokenBucket(config.SubscribeRateLimit),
 	}
 
 	s.server = &http.Server{
-		Addr:    addr,
+		Addr:    config.Addr,
 		Handler: s.newRouter(),
 	}
 
 	s.loadAndScheduleNotifications()
 	go s.startNotificationChannel()
+	s.startJanitor()
+	s.startRateLimitSweep()
 
 	return s
 }
@@ -80,46 +122,53 @@ func (s *Server) startNotificationChannel() {
 	}
 }
 
+// subscribers handled between the checkpoints of a notification
+const fanoutBatchSize = 500
+
 func (s *Server) ScheduleNotification(notification push.Notification) {
-	notificationKey := store.GetNotificationKey(notification.Topic, notification.ID)
-	s.store.SetStruct(notificationKey, notification)
+	// local time notifications are split into one batch per subscriber timezone
+	if notification.LocalTime && notification.Timezone == "" && notification.SubscriptionID == "" {
+		s.scheduleLocalNotification(notification)
+		return
+	}
 
-	job := func() {
-		subscriptions, err := s.store.GetSubscriptions(notification.Topic)
+	if err := s.store.AddNotification(notification.Topic, notification); err != nil {
+		log.Printf("[ERROR] Failed to store notification %s: %v", notification.ID, err)
+	}
+	s.schedule(notification)
+}
 
-		if err != nil {
-			log.Printf("[ERROR] Failed to get subscriptions: %v", err)
+// schedule sends a stored notification at its time.
+func (s *Server) schedule(notification push.Notification) {
+	job := func() {
+		if err := s.deliverNotification(notification); err != nil {
+			// it stays pending, and resumes from its checkpoint on restart
+			log.Printf("[ERROR] Failed to send notification %s: %v", notification.ID, err)
 			return
 		}
 
-		options := webpush.Options{
-			Topic:   notification.Topic,
-			TTL:     notification.Options.TTL,
-			Urgency: notification.Options.Urgency,
+		var b store.Batch
+		// keep whole topic notifications for replaying to new subscribers
+		if notification.SubscriptionID == "" && s.config.HistoryRetention > 0 {
+			entry, sentAt := s.historyEntry(notification)
+			b.AddHistory(entry, sentAt, s.config.HistoryRetention)
 		}
-
-		log.Printf("[INFO] Sending notification %s to %d subscriptions", notification.ID, len(subscriptions))
-
-		for _, subscription := range subscriptions {
-			status := s.push.Send(&subscription.Subscription, &notification.Payload, &options)
-			if status != push.PushStatusSuccess {
-				log.Printf("[ERROR] Failed to send notification. Status: %v", status)
-
-				if status == push.PushStatusHardFail {
-					// if fail, delete subscription
-					s.store.Delete(store.GetSubscriptionKey(notification.Topic, subscription.ID))
-				}
-			}
+		b.DeleteNotification(notification)
+		b.DeleteCheckpoint(notification)
+		if err := s.store.Apply(&b); err != nil {
+			log.Printf("[ERROR] Failed to complete notification %s: %v", notification.ID, err)
 		}
+	}
 
-		// delete notification from store
-		s.store.Delete(notificationKey)
+	sendAt := notification.Time
+	if notification.LocalTime && !sendAt.IsZero() {
+		sendAt = push.WallTime(sendAt, push.LoadLocation(notification.Timezone))
 	}
 
-	instant := notification.Time.IsZero()
+	instant := sendAt.IsZero()
 
 	// check if in the past
-	if !instant && notification.Time.Before(time.Now()) {
+	if !instant && sendAt.Before(time.Now()) {
 		log.Printf("[INFO] Notification %s is in the past, sending now", notification.ID)
 		instant = true
 	}
@@ -128,11 +177,254 @@ func (s *Server) ScheduleNotification(notification push.Notification) {
 		log.Printf("[INFO] Sending notification %s now", notification.ID)
 		job()
 	} else {
-		log.Printf("[INFO] Scheduling notification %s at %s", notification.ID, notification.Time)
-		s.scheduler.scheduleAt(notification.Time, notification.Topic, job)
+		log.Printf("[INFO] Scheduling notification %s at %s", notification.ID, sendAt)
+		s.scheduler.scheduleAt(sendAt, notification.Topic, job)
 	}
 }
 
+func (s *Server) scheduleLocalNotification(notification push.Notification) {
+	timezones := make(map[string]bool)
+	subscribers := s.store.IterateSubscribers(notification.Topic, "")
+	for subscribers.Next() {
+		subscription := subscribers.Subscription()
+		timezones[subscription.Location().String()] = true
+	}
+	if err := subscribers.Err(); err != nil {
+		log.Printf("[ERROR] Failed to get subscriptions: %v", err)
+		return
+	}
+
+	log.Printf("[INFO] Splitting notification %s into %d timezone batches", notification.ID, len(timezones))
+
+	// store every batch or none, so a restart doesn't send only some
+	batches := make([]push.Notification, 0, len(timezones))
+	var b store.Batch
+	for timezone := range timezones {
+		batch := notification
+		batch.Timezone = timezone
+		batches = append(batches, batch)
+		b.AddNotification(batch)
+	}
+	if err := s.store.Apply(&b); err != nil {
+		log.Printf("[ERROR] Failed to store notification %s: %v", notification.ID, err)
+		return
+	}
+
+	for _, batch := range batches {
+		s.schedule(batch)
+	}
+}
+
+// deliverNotification sends a notification to the topic's subscribers a
+// batch at a time. Each batch is checkpointed together with its delivery
+// counts, the changes to its subscriptions and the parts deferred for
+// subscribers in quiet hours, so an interrupted notification resumes after
+// the last batch instead of starting over.
+func (s *Server) deliverNotification(notification push.Notification) error {
+	after, err := s.store.GetCheckpoint(notification)
+	if err != nil {
+		return err
+	}
+
+	options := webpush.Options{
+		Topic:   notification.Topic,
+		TTL:     notification.Options.TTL,
+		Urgency: notification.Options.Urgency,
+	}
+
+	if after != "" {
+		log.Printf("[INFO] Resuming notification %s after %s", notification.ID, after)
+	} else {
+		log.Printf("[INFO] Sending notification %s", notification.ID)
+	}
+
+	now := time.Now()
+
+	sent := store.SentNotification{
+		ID:       notification.ID,
+		Topic:    notification.Topic,
+		SentAt:   now,
+		Variants: notification.VariantIDs(),
+	}
+	if err := s.store.AddSent(sent, s.config.StatsRetention); err != nil {
+		log.Printf("[ERROR] Failed to record notification %s as sent: %v", notification.ID, err)
+	}
+
+	// the batch so far: deliveries by variant, "" without variants, parts
+	// deferred by quiet hours and changes to subscriptions
+	delivered := map[string]int{}
+	deferred := make([]push.Notification, 0)
+	var updates store.Batch
+	handled, total := 0, 0
+
+	checkpoint := func(key string) error {
+		for variant, count := range delivered {
+			updates.IncrStats(sent, variant, push.EventDelivered, count, s.config.StatsRetention)
+		}
+		for _, d := range deferred {
+			updates.AddNotification(d)
+		}
+		updates.SetCheckpoint(notification, key)
+		if err := s.store.Apply(&updates); err != nil {
+			return err
+		}
+
+		for _, d := range deferred {
+			s.schedule(d)
+		}
+		delivered = map[string]int{}
+		deferred = deferred[:0]
+		updates = store.Batch{}
+		handled = 0
+		return nil
+	}
+
+	subscribers := s.store.IterateSubscribers(notification.Topic, after)
+	if notification.SubscriptionKey != "" {
+		// a single subscription, read instead of iterating the topic
+		subscribers = s.store.IterateSubscription(notification.SubscriptionKey, after)
+	}
+	for subscribers.Next() {
+		subscription := subscribers.Subscription()
+		if handled == fanoutBatchSize {
+			if err := checkpoint(after); err != nil {
+				return err
+			}
+		}
+		after = subscribers.Key()
+		handled++
+
+		if !notification.Targets(&subscription) {
+			continue
+		}
+		total++
+
+		if until, quiet := subscription.QuietUntil(now); quiet {
+			deferred = append(deferred, deferNotification(notification, subscription, subscribers.Key(), until))
+			continue
+		}
+
+		payload := notification.Payload
+		variant := ""
+		if v := notification.Variant(subscription.ID); v != nil {
+			payload = v.PushPayload
+			variant = v.ID
+
+			if err := s.store.SetAssignment(notification.ID, subscription.ID, variant, s.config.StatsRetention); err != nil {
+				log.Printf("[ERROR] Failed to record variant of notification %s: %v", notification.ID, err)
+			}
+		}
+
+		// let the service worker report events for the notification
+		payload.ID = notification.ID
+		payload.Topic = notification.Topic
+		payload.Variant = variant
+		payload.Track = s.trackingToken(notification.ID, subscription, variant)
+		payload.Redirect = s.trackedRedirect(notification.ID, payload.Redirect, subscription)
+
+		opts := options
+		if subscription.VapidKey != "" {
+			keys, ok := s.push.KeysFor(subscription.VapidKey)
+			if !ok {
+				log.Printf("[ERROR] Unknown VAPID key of subscription %s", subscription.ID)
+				continue
+			}
+			opts.VAPIDPublicKey = keys.VAPIDPublicKey
+			opts.VAPIDPrivateKey = keys.VAPIDPrivateKey
+		}
+
+		status := s.push.Send(&subscription.Subscription, &payload, &opts)
+		switch status {
+		case push.PushStatusSuccess:
+			delivered[variant]++
+			if subscription.Failures > 0 {
+				updates.ResetFailures(subscription)
+			}
+		case push.PushStatusTempFail:
+			log.Printf("[ERROR] Failed to send notification. Status: %v", status)
+
+			// the janitor prunes subscriptions that keep failing
+			updates.IncrFailures(subscription)
+		case push.PushStatusHardFail:
+			log.Printf("[ERROR] Failed to send notification. Status: %v", status)
+
+			// if fail, delete subscription
+			updates.DeleteSubscription(subscription)
+		}
+	}
+
+	// keep what was sent before a failure, to resume after it
+	if err := checkpoint(after); err != nil {
+		return err
+	}
+	if err := subscribers.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Sent notification %s to %d subscriptions", notification.ID, total)
+	return nil
+}
+
+// historyEntry returns the notification to keep in the topic's history, and
+// when it was sent. The timezone batches of a local time notification are
+// kept as the whole notification, sent with its first batch, so that each
+// batch writes the same entry.
+func (s *Server) historyEntry(notification push.Notification) (push.Notification, time.Time) {
+	sentAt := time.Now()
+	if notification.Timezone != "" {
+		notification.Timezone = ""
+		if sent, err := s.store.GetSent(notification.ID); err == nil {
+			sentAt = sent.SentAt
+		} else {
+			log.Printf("[ERROR] Failed to get notification %s: %v", notification.ID, err)
+		}
+	}
+	return notification, sentAt
+}
+
+// replayNotifications sends a new subscriber the latest notifications of the
+// topic, as configured on the topic.
+func (s *Server) replayNotifications(topic push.Topic, subscription push.Subscription) {
+	if topic.Replay.Count <= 0 {
+		return
+	}
+
+	since := time.Time{}
+	if topic.Replay.MaxAge > 0 {
+		since = time.Now().Add(-time.Duration(topic.Replay.MaxAge) * time.Second)
+	}
+
+	history, err := s.store.GetHistory(topic.ID, since, topic.Replay.Count)
+	if err != nil {
+		log.Printf("[ERROR] Failed to get history: %v", err)
+		return
+	}
+
+	log.Printf("[INFO] Replaying %d notifications to subscription %s", len(history), subscription.ID)
+
+	for _, notification := range history {
+		replay := notification
+		replay.Time = time.Time{}
+		replay.SubscriptionID = subscription.ID
+		replay.SubscriptionKey = store.GetSubscriptionKey(subscription.Topic, subscription.ID)
+		s.notifs <- &replay
+	}
+}
+
+// deferNotification holds a notification back for a single subscription,
+// stored at key, until its quiet hours are over.
+func deferNotification(notification push.Notification, subscription push.Subscription, key string, until time.Time) push.Notification {
+	log.Printf("[INFO] Subscription %s is in quiet hours, deferring notification %s", subscription.ID, notification.ID)
+
+	deferred := notification
+	deferred.Time = until.UTC()
+	deferred.LocalTime = false
+	deferred.Timezone = ""
+	deferred.SubscriptionID = subscription.ID
+	deferred.SubscriptionKey = key
+	return deferred
+}
+
 func (s *Server) Serve() (err error) {
 	log.Printf("[INFO] Server is listening on %s", s.server.Addr)
 	err = s.server.ListenAndServe()
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// pushService accepts pushes like a browser push service, recording the
+// endpoints they were sent to.
+type pushService struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []string
+}
+
+func newPushService(t *testing.T) *pushService {
+	t.Helper()
+	ps := &pushService{}
+	ps.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ps.mu.Lock()
+		ps.received = append(ps.received, strings.TrimPrefix(r.URL.Path, "/"))
+		ps.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(ps.Close)
+	return ps
+}
+
+// subscription returns a subscription with the endpoint id on the service.
+func (ps *pushService) subscription(topic, id, timezone string) push.Subscription {
+	return push.Subscription{
+		Subscription: webpush.Subscription{
+			Endpoint: ps.URL + "/" + id,
+			Keys: webpush.Keys{
+				P256dh: "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM",
+				Auth:   "tBHItJI5svbpez7KI4CCXg",
+			},
+		},
+		ID:        id,
+		Topic:     topic,
+		Timezone:  timezone,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// waitFor waits until the endpoint id received n pushes.
+func (ps *pushService) waitFor(t *testing.T, id string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if ps.count(id) >= n {
+			return
+		}
+	}
+	t.Fatalf("endpoint %s: got %d pushes, want %d", id, ps.count(id), n)
+}
+
+func (ps *pushService) count(id string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	count := 0
+	for _, received := range ps.received {
+		if received == id {
+			count++
+		}
+	}
+	return count
+}
+
+func TestLocalTimeHistory(t *testing.T) {
+	s := newTestServer(t, Config{HistoryRetention: time.Hour, StatsRetention: time.Hour})
+	ps := newPushService(t)
+
+	topic := push.Topic{ID: "news", Replay: push.ReplayOptions{Count: 5}}
+	if err := s.store.SetTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.AddSubscriptions([]push.Subscription{
+		ps.subscription("news", "paris", "Europe/Paris"),
+		ps.subscription("news", "tokyo", "Asia/Tokyo"),
+		ps.subscription("news", "utc", ""),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a wall clock time that has passed in every timezone, sent right away
+	s.ScheduleNotification(push.Notification{
+		Topic:     "news",
+		ID:        "n1",
+		Time:      time.Now().Add(-48 * time.Hour),
+		LocalTime: true,
+		Payload:   push.PushPayload{Title: "hi"},
+	})
+	for _, id := range []string{"paris", "tokyo", "utc"} {
+		ps.waitFor(t, id, 1)
+	}
+
+	history, err := s.store.GetHistory("news", time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("got %d history entries, want the notification once", len(history))
+	}
+	if history[0].ID != "n1" || history[0].Timezone != "" {
+		t.Errorf("got history entry %s of timezone %q, want n1 without timezone", history[0].ID, history[0].Timezone)
+	}
+
+	// a new subscriber in yet another timezone gets it replayed
+	newcomer := ps.subscription("news", "newyork", "America/New_York")
+	if err := s.store.AddSubscriptions([]push.Subscription{newcomer}); err != nil {
+		t.Fatal(err)
+	}
+	s.replayNotifications(topic, newcomer)
+	ps.waitFor(t, "newyork", 1)
+}
+
+func TestDeliverToSubscription(t *testing.T) {
+	s := newTestServer(t, Config{})
+	ps := newPushService(t)
+
+	wildcard := ps.subscription("news.*", "wildcard", "")
+	if err := s.store.AddSubscriptions([]push.Subscription{
+		ps.subscription("news.world", "plain", ""),
+		wildcard,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	notification := push.Notification{
+		Topic:           "news.world",
+		ID:              "n1",
+		Payload:         push.PushPayload{Title: "hi"},
+		SubscriptionID:  wildcard.ID,
+		SubscriptionKey: store.GetSubscriptionKey(wildcard.Topic, wildcard.ID),
+	}
+	if err := s.deliverNotification(notification); err != nil {
+		t.Fatal(err)
+	}
+	if ps.count("wildcard") != 1 || ps.count("plain") != 0 {
+		t.Errorf("got pushes %v, want only the wildcard subscription", ps.received)
+	}
+
+	// a subscription gone since is skipped
+	notification.ID = "n2"
+	notification.SubscriptionKey = store.GetSubscriptionKey("news.world", "gone")
+	if err := s.deliverNotification(notification); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.received) != 1 {
+		t.Errorf("got pushes %v, want none for a subscription gone", ps.received)
+	}
+}
+
+func TestDeferNotification(t *testing.T) {
+	s := newTestServer(t, Config{})
+	ps := newPushService(t)
+
+	// quiet for the hour around now, in UTC
+	now := time.Now().UTC()
+	quiet := ps.subscription("news.*", "quiet", "")
+	quiet.QuietHours = &push.QuietHours{Start: now.Add(-time.Hour).Format("15:04"), End: now.Add(time.Hour).Format("15:04")}
+	if err := s.store.AddSubscriptions([]push.Subscription{quiet, ps.subscription("news.world", "awake", "")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.deliverNotification(push.Notification{Topic: "news.world", ID: "n1", Payload: push.PushPayload{Title: "hi"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ps.count("awake") != 1 || ps.count("quiet") != 0 {
+		t.Errorf("got pushes %v, want only the subscription out of quiet hours", ps.received)
+	}
+
+	// the deferred part reads the wildcard subscription by its key
+	pending, err := s.store.GetNotifications()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("got %d pending notifications, want the deferred one", len(pending))
+	}
+	deferred := pending[0]
+	if deferred.SubscriptionID != "quiet" || deferred.SubscriptionKey != store.GetSubscriptionKey("news.*", "quiet") {
+		t.Errorf("got deferred to %q at %q", deferred.SubscriptionID, deferred.SubscriptionKey)
+	}
+	if !deferred.Time.After(now) {
+		t.Errorf("got deferred until %s, want after the quiet hours", deferred.Time)
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// topics are dotted hierarchies like "sports.football.team42"
+const topicIDPattern = `[a-z0-9_-]+(?:\.[a-z0-9_-]+)*`
+
+// wildcard topics like "sports.*" can be subscribed to, reaching every topic below
+const topicRoutePattern = topicIDPattern + `(?:\.\*)?`
+
+var topicIDRegexp = regexp.MustCompile(`^` + topicIDPattern + `$`)
+
+func isWildcardTopic(topic string) bool {
+	return strings.HasSuffix(topic, ".*")
+}
+
+// noWildcard rejects wildcard topics on routes that need a concrete topic.
+func noWildcard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWildcardTopic(chi.URLParam(r, "id")) {
+			render.Render(w, r, errBadRequest("wildcard topics can only be subscribed to"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (tr *topicRequest) apply(topic *push.Topic) {
+	topic.Name = tr.Name
+	topic.Description = tr.Description
+	topic.Owner = tr.Owner
+	topic.Defaults = tr.Defaults
+	topic.Replay = tr.Replay
+	topic.Archived = tr.Archived
+}
+
+func (s *Server) createTopic(w http.ResponseWriter, r *http.Request) {
+	data := &topicRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	if !topicIDRegexp.MatchString(data.ID) {
+		render.Render(w, r, errBind(validationErrors{{Field: "id", Message: "must match " + topicIDPattern}}))
+		return
+	}
+
+	topic := push.Topic{
+		ID:        data.ID,
+		CreatedAt: time.Now().UTC(),
+	}
+	data.apply(&topic)
+
+	created, err := s.store.CreateTopic(topic)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to create topic", err))
+		return
+	}
+	if !created {
+		render.Render(w, r, errConflict("topic already exists"))
+		return
+	}
+
+	count, err := s.store.CountSubscriptions(topic.ID)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count subscriptions", err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, newTopicResponse(topic, count))
+}
+
+func (s *Server) getTopic(w http.ResponseWriter, r *http.Request) {
+	topicId := chi.URLParam(r, "id")
+
+	count, err := s.store.CountSubscriptions(topicId)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count subscriptions", err))
+		return
+	}
+
+	topic, err := s.store.GetTopic(topicId)
+	if err == store.ErrNotFound {
+		// topics with subscribers exist without being registered
+		if count == 0 {
+			render.Render(w, r, errNotFound("unknown topic"))
+			return
+		}
+		topic = push.Topic{ID: topicId}
+	} else if err != nil {
+		render.Render(w, r, errInternal("failed to get topic", err))
+		return
+	}
+
+	render.JSON(w, r, newTopicResponse(topic, count))
+}
+
+// updateTopic replaces the metadata of a topic, registering it if needed.
+func (s *Server) updateTopic(w http.ResponseWriter, r *http.Request) {
+	topicId := chi.URLParam(r, "id")
+
+	data := &topicRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, errBind(err))
+		return
+	}
+
+	topic, err := s.store.GetTopic(topicId)
+	if err == store.ErrNotFound {
+		topic = push.Topic{
+			ID:        topicId,
+			CreatedAt: time.Now().UTC(),
+		}
+	} else if err != nil {
+		render.Render(w, r, errInternal("failed to get topic", err))
+		return
+	}
+	data.apply(&topic)
+
+	if err := s.store.SetTopic(topic); err != nil {
+		render.Render(w, r, errInternal("failed to update topic", err))
+		return
+	}
+
+	count, err := s.store.CountSubscriptions(topicId)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to count subscriptions", err))
+		return
+	}
+
+	render.JSON(w, r, newTopicResponse(topic, count))
+}
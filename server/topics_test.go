@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+func TestListTopicsArchived(t *testing.T) {
+	s := newTestServer(t, Config{})
+	// every third topic is live
+	for i := 0; i < 9; i++ {
+		topic := push.Topic{ID: fmt.Sprintf("t%d", i), Archived: i%3 != 0}
+		if err := s.store.SetTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a topic that only exists through its subscriptions counts as live
+	if err := s.store.AddSubscriptions([]push.Subscription{{ID: "s1", Topic: "t9"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		pages [][]string
+	}{
+		{"archived=false&limit=2", [][]string{{"t0", "t3"}, {"t6", "t9"}}},
+		{"archived=true&limit=4", [][]string{{"t1", "t2", "t4", "t5"}, {"t7", "t8"}}},
+		{"limit=5", [][]string{{"t0", "t1", "t2", "t3", "t4"}, {"t5", "t6", "t7", "t8", "t9"}}},
+	}
+	for _, tt := range tests {
+		cursor := ""
+		for i, want := range tt.pages {
+			var resp topicsResponse
+			path := "/api/topics?" + tt.query
+			if cursor != "" {
+				path += "&cursor=" + cursor
+			}
+			if rec := serve(t, s, http.MethodGet, path, nil, nil, &resp); rec.Code != http.StatusOK {
+				t.Fatalf("%s: got status %d", path, rec.Code)
+			}
+
+			got := make([]string, 0, len(resp.Topics))
+			for _, topic := range resp.Topics {
+				got = append(got, topic.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%s page %d: got %v, want %v", tt.query, i, got, want)
+			}
+
+			last := i == len(tt.pages)-1
+			if (resp.Next == "") != last {
+				t.Errorf("%s page %d: got next %q, want one only before the last page", tt.query, i, resp.Next)
+			}
+			cursor = resp.Next
+		}
+	}
+}
+
+func TestCreateTopicConcurrently(t *testing.T) {
+	s := newTestServer(t, Config{})
+
+	const requests = 20
+	statuses := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := map[string]string{"id": "news", "name": fmt.Sprint(i)}
+			statuses <- serve(t, s, http.MethodPost, "/api/topics", nil, body, nil).Code
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusConflict] != requests-1 {
+		t.Errorf("got statuses %v, want one %d and the rest %d", counts, http.StatusCreated, http.StatusConflict)
+	}
+}
+
+func TestTopicWritesRequireAPIKey(t *testing.T) {
+	s := newTestServer(t, Config{APIKeys: []string{"a"}})
+	if err := s.store.SetTopic(push.Topic{ID: "news"}); err != nil {
+		t.Fatal(err)
+	}
+	key := func(k string) http.Header { return http.Header{"X-Api-Key": {k}} }
+	topic := map[string]interface{}{"name": "News"}
+
+	tests := []struct {
+		method string
+		path   string
+		header http.Header
+		body   interface{}
+		status int
+	}{
+		{http.MethodPost, "/api/topics", nil, map[string]interface{}{"id": "sports"}, http.StatusUnauthorized},
+		{http.MethodPost, "/api/topics", key("b"), map[string]interface{}{"id": "sports"}, http.StatusUnauthorized},
+		{http.MethodPut, "/api/topic/news", nil, topic, http.StatusUnauthorized},
+		{http.MethodPut, "/api/topic/news", key("b"), topic, http.StatusUnauthorized},
+		{http.MethodDelete, "/api/topic/news", nil, nil, http.StatusUnauthorized},
+		{http.MethodDelete, "/api/topic/news", key("b"), nil, http.StatusUnauthorized},
+		{http.MethodGet, "/api/topic/news", nil, nil, http.StatusOK},
+		{http.MethodPost, "/api/topics", key("a"), map[string]interface{}{"id": "sports"}, http.StatusCreated},
+		{http.MethodPut, "/api/topic/news", key("a"), topic, http.StatusOK},
+		{http.MethodDelete, "/api/topic/news", key("a"), nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, s, tt.method, tt.path, tt.header, tt.body, nil); rec.Code != tt.status {
+			t.Errorf("%s %s with %v: got status %d, want %d", tt.method, tt.path, tt.header, rec.Code, tt.status)
+		}
+	}
+}
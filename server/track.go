@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// trackEvents maps the events in tracking URLs to the counted events,
+// deliveries are counted by the server itself.
+var trackEvents = map[string]push.Event{
+	"display": push.EventDisplayed,
+	"click":   push.EventClicked,
+	"close":   push.EventClosed,
+}
+
+// track counts an event reported by a service worker with the tracking token
+// of a delivery, the first report of each event per subscription only.
+func (s *Server) track(w http.ResponseWriter, r *http.Request) {
+	var token trackToken
+	if err := s.tracking.verify(chi.URLParam(r, "token"), &token); err != nil {
+		render.Render(w, r, errNotFound("unknown token"))
+		return
+	}
+
+	event, ok := trackEvents[chi.URLParam(r, "event")]
+	if !ok {
+		render.Render(w, r, errBadRequest("unknown event"))
+		return
+	}
+
+	sent, err := s.store.GetSent(token.Notification)
+	if err == store.ErrNotFound {
+		render.Render(w, r, errNotFound("unknown notification"))
+		return
+	} else if err != nil {
+		render.Render(w, r, errInternal("failed to get notification", err))
+		return
+	}
+
+	first, err := s.store.AddReport(store.Report{
+		Notification: token.Notification,
+		Subscription: token.Subscription,
+		Event:        event,
+		ReportedAt:   time.Now().UTC(),
+	}, s.config.StatsRetention)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to track event", err))
+		return
+	}
+	if !first {
+		render.JSON(w, r, newSuccessResponse("event already tracked"))
+		return
+	}
+
+	if err := s.store.IncrStats(sent, token.Variant, event, 1, s.config.StatsRetention); err != nil {
+		render.Render(w, r, errInternal("failed to track event", err))
+		return
+	}
+
+	render.JSON(w, r, newSuccessResponse("event tracked"))
+}
+
+func (s *Server) notificationAnalytics(w http.ResponseWriter, r *http.Request) {
+	notificationId := chi.URLParam(r, "nid")
+
+	sent, err := s.store.GetSent(notificationId)
+	if err == store.ErrNotFound {
+		render.Render(w, r, errNotFound("unknown notification"))
+		return
+	} else if err != nil {
+		render.Render(w, r, errInternal("failed to get notification", err))
+		return
+	}
+
+	stats, err := s.store.GetNotificationStats(sent.ID)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to get stats", err))
+		return
+	}
+
+	variants := make([]variantFunnel, 0, len(sent.Variants))
+	for _, variant := range sent.Variants {
+		stats, err := s.store.GetVariantStats(sent.ID, variant)
+		if err != nil {
+			render.Render(w, r, errInternal("failed to get stats", err))
+			return
+		}
+		variants = append(variants, variantFunnel{ID: variant, funnel: newFunnel(stats)})
+	}
+
+	render.JSON(w, r, newAnalyticsResponse(sent.Topic, sent.ID, stats, variants))
+}
+
+func (s *Server) topicAnalytics(w http.ResponseWriter, r *http.Request) {
+	topicId := chi.URLParam(r, "id")
+
+	stats, err := s.store.GetTopicStats(topicId)
+	if err != nil {
+		render.Render(w, r, errInternal("failed to get stats", err))
+		return
+	}
+
+	render.JSON(w, r, newAnalyticsResponse(topicId, "", stats, nil))
+}
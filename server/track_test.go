@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+	"github.com/destruc7i0n/webpush-api/store"
+)
+
+func TestTrack(t *testing.T) {
+	s := newTestServer(t, Config{StatsRetention: time.Hour})
+	sent := store.SentNotification{ID: "n1", Topic: "news", SentAt: time.Now(), Variants: []string{"a", "b"}}
+	if err := s.store.AddSent(sent, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := s.trackingToken("n1", push.Subscription{ID: "alice"}, "a")
+	bob := s.trackingToken("n1", push.Subscription{ID: "bob"}, "b")
+	forged := s.links.sign(trackToken{Notification: "n1", Subscription: "mallory", Variant: "a"})
+	redirect := s.links.sign(redirectLink{Notification: "n1", Subscription: "mallory", URL: "https://example.com"})
+
+	tests := []struct {
+		name   string
+		token  string
+		event  string
+		status int
+	}{
+		{"display", alice, "display", http.StatusOK},
+		{"display again", alice, "display", http.StatusOK},
+		{"click", alice, "click", http.StatusOK},
+		{"other subscription", bob, "display", http.StatusOK},
+		{"unknown event", bob, "open", http.StatusBadRequest},
+		{"signed with the link key", forged, "display", http.StatusNotFound},
+		{"redirect token", redirect, "display", http.StatusNotFound},
+		{"garbage", "n1", "display", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := serve(t, s, http.MethodPost, "/api/track/"+tt.token+"/"+tt.event, nil, nil, nil)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body.String())
+		}
+	}
+
+	// a click through the redirect link of alice was already counted
+	s.recordClick(redirectLink{Notification: "n1", Subscription: "alice", URL: "https://example.com"})
+
+	want := map[string]push.Stats{
+		"":  {push.EventDisplayed: 2, push.EventClicked: 1},
+		"a": {push.EventDisplayed: 1, push.EventClicked: 1},
+		"b": {push.EventDisplayed: 1},
+	}
+	for variant, events := range want {
+		var stats push.Stats
+		var err error
+		if variant == "" {
+			stats, err = s.store.GetNotificationStats("n1")
+		} else {
+			stats, err = s.store.GetVariantStats("n1", variant)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for event, count := range events {
+			if stats[event] != count {
+				t.Errorf("variant %q: got %d %s, want %d", variant, stats[event], event, count)
+			}
+		}
+	}
+}
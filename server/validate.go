@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors collects the problems found with each field of a request.
+type validationErrors []fieldError
+
+func (v validationErrors) Error() string {
+	messages := make([]string, 0, len(v))
+	for _, e := range v {
+		messages = append(messages, fmt.Sprintf("%s %s", e.Field, e.Message))
+	}
+	return strings.Join(messages, ", ")
+}
+
+// check records a field error when ok is false.
+func (v *validationErrors) check(ok bool, field, message string) {
+	if !ok {
+		*v = append(*v, fieldError{Field: field, Message: message})
+	}
+}
+
+// checkErr records a field error for a non-nil err.
+func (v *validationErrors) checkErr(err error, field string) {
+	if err != nil {
+		*v = append(*v, fieldError{Field: field, Message: err.Error()})
+	}
+}
+
+// err returns the collected errors, or nil if there are none.
+func (v validationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// isURL reports whether value is an absolute http(s) url, or empty.
+func isURL(value string) bool {
+	if value == "" {
+		return true
+	}
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+// Batch collects writes that Apply runs in a single transaction, so either
+// all of them happen or none do. The zero value is an empty batch.
+type Batch struct {
+	ops []func(s *Store, tx *buntdb.Tx) error
+	// the first value that failed to encode, returned by Apply
+	err error
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Set(key string, value []byte) {
+	b.SetTTL(key, value, 0)
+}
+
+// SetTTL sets a key that expires after ttl, 0 for no expiry.
+func (b *Batch) SetTTL(key string, value []byte, ttl time.Duration) {
+	b.ops = append(b.ops, func(s *Store, tx *buntdb.Tx) error {
+		val, err := s.seal(key, string(value))
+		if err != nil {
+			return err
+		}
+		return setTx(tx, key, val, expiry(ttl))
+	})
+}
+
+func (b *Batch) SetStruct(key string, value interface{}) {
+	b.SetStructTTL(key, value, 0)
+}
+
+func (b *Batch) SetStructTTL(key string, value interface{}, ttl time.Duration) {
+	val, err := json.Marshal(value)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return
+	}
+	b.SetTTL(key, val, ttl)
+}
+
+// Incr adds to an integer counter like Store.Incr.
+func (b *Batch) Incr(key string, by int, ttl time.Duration) {
+	b.ops = append(b.ops, func(s *Store, tx *buntdb.Tx) error {
+		return incr(tx, key, by, ttl)
+	})
+}
+
+// Delete deletes a key, keys that don't exist are ignored.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, func(s *Store, tx *buntdb.Tx) error {
+		err := deleteTx(tx, key)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// DeletePattern deletes every key matching pattern, as they are when the
+// batch is applied.
+func (b *Batch) DeletePattern(pattern string) {
+	b.ops = append(b.ops, func(s *Store, tx *buntdb.Tx) error {
+		keys := make([]string, 0)
+		err := tx.AscendKeys(pattern, func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := deleteTx(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeletePrefix deletes every key starting with prefix, as they are when the
+// batch is applied. Unlike DeletePattern, the prefix is matched literally.
+func (b *Batch) DeletePrefix(prefix string) {
+	b.ops = append(b.ops, func(s *Store, tx *buntdb.Tx) error {
+		keys := make([]string, 0)
+		err := tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := deleteTx(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Apply runs the writes of the batch in order, in a single transaction.
+func (s *Store) Apply(b *Batch) error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		for _, op := range b.ops {
+			if err := op(s, tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func expiry(ttl time.Duration) *buntdb.SetOptions {
+	if ttl <= 0 {
+		return nil
+	}
+	return &buntdb.SetOptions{Expires: true, TTL: ttl}
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+func TestApplyRollsBack(t *testing.T) {
+	s := newTestStore(t)
+	seedTopic(t, s, "news")
+	if err := s.Set("counter", []byte("not a number")); err != nil {
+		t.Fatal(err)
+	}
+
+	var b Batch
+	b.SetSubscription(testSubscription("news", "s2"))
+	b.DeletePrefix(GetNotificationKey("news", ""))
+	b.Delete(GetTopicKey("news"))
+	// fails after the writes above
+	b.Incr("counter", 1, 0)
+	if err := s.Apply(&b); err == nil {
+		t.Fatal("apply: got no error")
+	}
+
+	if _, err := s.Get(GetSubscriptionKey("news", "s2")); err != ErrNotFound {
+		t.Errorf("s2: got %v, want it not stored", err)
+	}
+	if _, err := s.GetTopic("news"); err != nil {
+		t.Errorf("topic: got %v, want it kept", err)
+	}
+	if count, _ := s.CountNotifications("news"); count != 1 {
+		t.Errorf("got %d notifications, want the one kept", count)
+	}
+	if count, _ := s.CountSubscriptions("news"); count != 1 {
+		t.Errorf("got %d subscriptions counted, want 1", count)
+	}
+	if due, found, _ := s.NextDue(); !found || due.IsZero() {
+		t.Errorf("got due %v, %v, want the notification still indexed", due, found)
+	}
+}
+
+func TestApplyEncodeError(t *testing.T) {
+	s := newTestStore(t)
+
+	var b Batch
+	b.SetSubscription(testSubscription("news", "s1"))
+	b.SetStruct("bad", make(chan int))
+	b.AddNotification(push.Notification{Topic: "news", ID: "n1", Time: time.Now()})
+	if err := s.Apply(&b); err == nil {
+		t.Fatal("apply: got no error")
+	}
+
+	if count, _ := s.Count("*"); count != 0 {
+		t.Errorf("got %d keys, want none written", count)
+	}
+}
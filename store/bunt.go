@@ -1,34 +1,80 @@
 package store
 
 import (
+	"crypto/cipher"
 	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
 
 	buntdb "github.com/tidwall/buntdb"
+	"github.com/tidwall/match"
 )
 
+// ErrNotFound is returned when a key does not exist.
+var ErrNotFound = buntdb.ErrNotFound
+
 type Store struct {
 	db *buntdb.DB
+	// encrypts the secrets of records, nil while they are in plain text
+	dataKey cipher.AEAD
 }
 
 func NewStore() (*Store, error) {
 	// db, err := buntdb.Open(":memory:")
-	db, err := buntdb.Open("store.db")
-
-	db.Shrink() // compact the database
+	return Open("store.db", nil)
+}
 
+// Open opens the database file at path, creating it if needed. Databases
+// written by a newer build are refused; older ones need Migrate. Encrypted
+// databases need their master key, which is ignored for others until Rekey.
+func Open(path string, masterKey []byte) (*Store, error) {
+	db, err := buntdb.Open(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Store{
+	s := &Store{
 		db: db,
-	}, nil
+	}
+
+	if err := createIndexes(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	version, err := s.SchemaVersion()
+	if err == nil && version > SchemaVersion {
+		err = fmt.Errorf("%w: version %d, supported %d", ErrSchemaTooNew, version, SchemaVersion)
+	}
+	if err == nil {
+		err = s.unlock(masterKey)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	db.Shrink() // compact the database
+
+	return s, nil
 }
 
 func (s *Store) Close() error {
 	return s.db.Close()
 }
 
+// Compact rewrites the database file without overwritten and expired entries.
+func (s *Store) Compact() error {
+	return s.db.Shrink()
+}
+
+// Backup writes a consistent copy of the database, which Open can read.
+func (s *Store) Backup(w io.Writer) error {
+	return s.db.Save(w)
+}
+
 func (s *Store) Get(key string) ([]byte, error) {
 	var val []byte
 	err := s.db.View(func(tx *buntdb.Tx) error {
@@ -43,17 +89,85 @@ func (s *Store) Get(key string) ([]byte, error) {
 }
 
 func (s *Store) Set(key string, value []byte) error {
+	val, err := s.seal(key, string(value))
+	if err != nil {
+		return err
+	}
 	return s.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(key, string(value), nil)
+		return setTx(tx, key, val, nil)
+	})
+}
+
+// SetTTL sets a key that expires after ttl.
+func (s *Store) SetTTL(key string, value []byte, ttl time.Duration) error {
+	val, err := s.seal(key, string(value))
+	if err != nil {
 		return err
+	}
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		return setTx(tx, key, val, &buntdb.SetOptions{Expires: true, TTL: ttl})
 	})
 }
 
+// SetIfAbsent sets a key that expires after ttl, 0 for no expiry, unless it
+// already exists. It reports whether the value was set.
+func (s *Store) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	val, err := s.seal(key, string(value))
+	if err != nil {
+		return false, err
+	}
+
+	set := false
+	err = s.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(key)
+		if err == nil {
+			return nil
+		}
+		if err != buntdb.ErrNotFound {
+			return err
+		}
+
+		err = setTx(tx, key, val, expiry(ttl))
+		set = err == nil
+		return err
+	})
+	return set, err
+}
+
+// Incr adds to an integer counter, creating it with the given ttl (0 for no
+// expiry) if needed. Existing counters keep their expiry.
+func (s *Store) Incr(key string, by int, ttl time.Duration) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		return incr(tx, key, by, ttl)
+	})
+}
+
+func incr(tx *buntdb.Tx, key string, by int, ttl time.Duration) error {
+	count := 0
+	opts := expiry(ttl)
+
+	val, err := tx.Get(key)
+	if err == nil {
+		if count, err = strconv.Atoi(val); err != nil {
+			return err
+		}
+		remaining, err := tx.TTL(key)
+		if err != nil {
+			return err
+		}
+		opts = expiry(remaining)
+	} else if err != buntdb.ErrNotFound {
+		return err
+	}
+
+	_, _, err = tx.Set(key, strconv.Itoa(count+by), opts)
+	return err
+}
+
 func (s *Store) Delete(key string) error {
 	// log.Printf("deleting key %s", key)
 	return s.db.Update(func(tx *buntdb.Tx) error {
-		_, err := tx.Delete(key)
-		return err
+		return deleteTx(tx, key)
 	})
 }
 
@@ -68,6 +182,24 @@ func (s *Store) SetStruct(key string, value interface{}) error {
 	return s.Set(key, val)
 }
 
+func (s *Store) SetStructTTL(key string, value interface{}, ttl time.Duration) error {
+	val, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.SetTTL(key, val, ttl)
+}
+
+func (s *Store) SetStructIfAbsent(key string, value interface{}, ttl time.Duration) (bool, error) {
+	val, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+
+	return s.SetIfAbsent(key, val, ttl)
+}
+
 func (s *Store) GetStruct(key string, value interface{}) error {
 	// get the value
 	val, err := s.Get(key)
@@ -76,7 +208,7 @@ func (s *Store) GetStruct(key string, value interface{}) error {
 	}
 
 	// decode the value
-	return json.Unmarshal(val, value)
+	return s.unmarshal(key, string(val), value)
 }
 
 func (s *Store) AscendBy(prefix string) (map[string]string, error) {
@@ -90,3 +222,65 @@ func (s *Store) AscendBy(prefix string) (map[string]string, error) {
 	})
 	return list, err
 }
+
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Page is a run of entries in key order. Next is the key to continue after,
+// empty on the last page.
+type Page struct {
+	Entries []Entry
+	Next    string
+}
+
+// AscendPage returns up to limit entries matching pattern with keys after
+// the given key, skipping entries the filter rejects. A nil filter keeps all.
+func (s *Store) AscendPage(pattern, after string, limit int, filter func(key, value string) bool) (Page, error) {
+	page := Page{Entries: make([]Entry, 0, limit)}
+
+	min, max := match.Allowable(pattern)
+	pivot := min
+	if after != "" && after >= min {
+		// the smallest key greater than after
+		pivot = after + "\x00"
+	}
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendGreaterOrEqual("", pivot, func(key, value string) bool {
+			if max != "" && key > max {
+				return false
+			}
+			if !match.Match(key, pattern) {
+				return true
+			}
+			if filter != nil && !filter(key, value) {
+				return true
+			}
+
+			if len(page.Entries) == limit {
+				// there is at least one more entry
+				page.Next = page.Entries[limit-1].Key
+				return false
+			}
+
+			page.Entries = append(page.Entries, Entry{Key: key, Value: value})
+			return true
+		})
+	})
+
+	return page, err
+}
+
+// Count returns the number of keys matching pattern.
+func (s *Store) Count(pattern string) (int, error) {
+	count := 0
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(pattern, func(key, value string) bool {
+			count++
+			return true
+		})
+	})
+	return count, err
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAscendPage(t *testing.T) {
+	s := newTestStore(t)
+	setRaw(t, s, map[string]string{
+		"a:1": "1", "a:2": "2", "a:3": "3", "a:4": "4", "a:5": "5",
+		"a": "before", "b:1": "after",
+	})
+	skip3 := func(key, value string) bool { return value != "3" }
+
+	tests := []struct {
+		name   string
+		after  string
+		limit  int
+		filter func(key, value string) bool
+		want   string
+		next   string
+	}{
+		{"first page", "", 2, nil, "[a:1 a:2]", "a:2"},
+		{"middle page", "a:2", 2, nil, "[a:3 a:4]", "a:4"},
+		{"last page", "a:4", 2, nil, "[a:5]", ""},
+		{"exactly the rest", "a:3", 2, nil, "[a:4 a:5]", ""},
+		{"after the end", "a:5", 2, nil, "[]", ""},
+		{"cursor before the pattern", "0", 2, nil, "[a:1 a:2]", "a:2"},
+		{"filtered first page", "", 3, skip3, "[a:1 a:2 a:4]", "a:4"},
+		{"filtered across pages", "a:2", 2, skip3, "[a:4 a:5]", ""},
+	}
+	for _, tt := range tests {
+		page, err := s.AscendPage("a:*", tt.after, tt.limit, tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, 0, len(page.Entries))
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if got := fmt.Sprint(keys); got != tt.want || page.Next != tt.next {
+			t.Errorf("%s: got %s next %q, want %s next %q", tt.name, got, page.Next, tt.want, tt.next)
+		}
+	}
+}
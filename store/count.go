@@ -0,0 +1,247 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+// Counters are kept for subscriptions in total, by topic and by push
+// service, for pending notifications in total and by topic, and for the keys
+// below each topic, which exists as long as it has any. They change in the
+// same transaction as the records, through setTx and deleteTx.
+
+const (
+	countSubscriptions = "subscriptions"
+	countHosts         = "hosts"
+	countNotifications = "notifications"
+	countTopicKeys     = "topicKeys"
+	countTopics        = "topics"
+)
+
+func getCountKey(parts ...string) string {
+	return fmt.Sprintf("%s:%s", KeyCount, strings.Join(parts, ":"))
+}
+
+// GetSubscriptionCountKey counts the subscriptions of a topic, of all topics for "*".
+func GetSubscriptionCountKey(topic string) string {
+	if topic == "*" {
+		return getCountKey(countSubscriptions)
+	}
+	return getCountKey(countSubscriptions, topic)
+}
+
+func GetHostCountKey(host string) string {
+	return getCountKey(countHosts, host)
+}
+
+// GetNotificationCountKey counts the pending notifications of a topic, of
+// all topics for "*".
+func GetNotificationCountKey(topic string) string {
+	if topic == "*" {
+		return getCountKey(countNotifications)
+	}
+	return getCountKey(countNotifications, topic)
+}
+
+// setTx sets a key and updates the counters and due keys it is in.
+func setTx(tx *buntdb.Tx, key, value string, opts *buntdb.SetOptions) error {
+	prev, replaced, err := tx.Set(key, value, opts)
+	if err != nil {
+		return err
+	}
+	if !replaced {
+		prev = ""
+	}
+	if err := indexDueTx(tx, key, prev, value); err != nil {
+		return err
+	}
+
+	deltas := make(map[string]int)
+	if replaced {
+		for _, counter := range counters(key, prev) {
+			deltas[counter]--
+		}
+	}
+	for _, counter := range counters(key, value) {
+		deltas[counter]++
+	}
+	return countTx(tx, deltas)
+}
+
+// deleteTx deletes a key and updates the counters and due keys it was in.
+func deleteTx(tx *buntdb.Tx, key string) error {
+	prev, err := tx.Delete(key)
+	if err != nil {
+		return err
+	}
+	if err := indexDueTx(tx, key, prev, ""); err != nil {
+		return err
+	}
+
+	deltas := make(map[string]int)
+	for _, counter := range counters(key, prev) {
+		deltas[counter]--
+	}
+	return countTx(tx, deltas)
+}
+
+// counters returns the counters a record is in.
+func counters(key, value string) []string {
+	parts := strings.Split(key, ":")
+
+	switch {
+	case parts[0] == string(KeyTopic) && len(parts) == 2:
+		return []string{getCountKey(countTopicKeys, parts[1])}
+	case parts[0] == string(KeyTopic) && len(parts) == 4 && (parts[2] == string(KeySubscription) || parts[2] == string(KeyWildcard)):
+		topic := parts[1]
+		if parts[2] == string(KeyWildcard) {
+			topic += ".*"
+		}
+		keys := []string{
+			getCountKey(countTopicKeys, parts[1]),
+			GetSubscriptionCountKey("*"),
+			GetSubscriptionCountKey(topic),
+		}
+		if host := endpointHost(value); host != "" {
+			keys = append(keys, GetHostCountKey(host))
+		}
+		return keys
+	case parts[0] == string(KeyNotification) && len(parts) >= 3:
+		return []string{GetNotificationCountKey("*"), GetNotificationCountKey(parts[1])}
+	}
+	return nil
+}
+
+func endpointHost(value string) string {
+	var subscription struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.Unmarshal([]byte(value), &subscription); err != nil {
+		return ""
+	}
+	u, err := url.Parse(subscription.Endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func countTx(tx *buntdb.Tx, deltas map[string]int) error {
+	for counter, by := range deltas {
+		if by == 0 {
+			continue
+		}
+		before, after, err := addCount(tx, counter, by)
+		if err != nil {
+			return err
+		}
+
+		// a topic exists while there are keys below it
+		if strings.HasPrefix(counter, getCountKey(countTopicKeys)+":") {
+			if before == 0 && after > 0 {
+				_, _, err = addCount(tx, getCountKey(countTopics), 1)
+			} else if before > 0 && after == 0 {
+				_, _, err = addCount(tx, getCountKey(countTopics), -1)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addCount adds to a counter, deleting it when it drops to zero.
+func addCount(tx *buntdb.Tx, key string, by int) (before, after int, err error) {
+	val, err := tx.Get(key)
+	if err == nil {
+		if before, err = strconv.Atoi(val); err != nil {
+			return 0, 0, err
+		}
+	} else if err != buntdb.ErrNotFound {
+		return 0, 0, err
+	}
+
+	after = before + by
+	if after <= 0 {
+		after = 0
+		if before > 0 {
+			_, err = tx.Delete(key)
+		}
+		return before, after, err
+	}
+	_, _, err = tx.Set(key, strconv.Itoa(after), nil)
+	return before, after, err
+}
+
+func (s *Store) getCount(key string) (int, error) {
+	count := 0
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(key)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		count, err = strconv.Atoi(val)
+		return err
+	})
+	return count, err
+}
+
+// CountSubscriptionsByHost returns the number of subscriptions of each push
+// service.
+func (s *Store) CountSubscriptionsByHost() (map[string]int, error) {
+	counts := make(map[string]int)
+	prefix := GetHostCountKey("")
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var parseErr error
+		err := tx.AscendKeys(prefix+"*", func(key, value string) bool {
+			counts[strings.TrimPrefix(key, prefix)], parseErr = strconv.Atoi(value)
+			return parseErr == nil
+		})
+		if err != nil {
+			return err
+		}
+		return parseErr
+	})
+	return counts, err
+}
+
+// recount rebuilds the counters from the records.
+func recount(tx *buntdb.Tx) error {
+	stale := make([]string, 0)
+	err := tx.AscendKeys(getCountKey("*"), func(key, value string) bool {
+		stale = append(stale, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if _, err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	deltas := make(map[string]int)
+	count := func(key, value string) bool {
+		for _, counter := range counters(key, value) {
+			deltas[counter]++
+		}
+		return true
+	}
+	if err := tx.AscendKeys(GetTopicKey("*"), count); err != nil {
+		return err
+	}
+	if err := tx.AscendKeys(GetNotificationKey("*", "*"), count); err != nil {
+		return err
+	}
+	return countTx(tx, deltas)
+}
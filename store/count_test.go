@@ -0,0 +1,126 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+type counts struct {
+	subscriptions map[string]int
+	notifications map[string]int
+	topics        int
+	hosts         map[string]int
+}
+
+func checkCounts(t *testing.T, s *Store, want counts) {
+	t.Helper()
+	for topic, n := range want.subscriptions {
+		if got, err := s.CountSubscriptions(topic); err != nil || got != n {
+			t.Errorf("subscriptions of %s: got %d, %v, want %d", topic, got, err, n)
+		}
+	}
+	for topic, n := range want.notifications {
+		if got, err := s.CountNotifications(topic); err != nil || got != n {
+			t.Errorf("notifications of %s: got %d, %v, want %d", topic, got, err, n)
+		}
+	}
+	if got, err := s.CountTopics(); err != nil || got != want.topics {
+		t.Errorf("topics: got %d, %v, want %d", got, err, want.topics)
+	}
+	hosts, err := s.CountSubscriptionsByHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(hosts) != fmt.Sprint(want.hosts) {
+		t.Errorf("hosts: got %v, want %v", hosts, want.hosts)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	s := newTestStore(t)
+
+	other := testSubscription("news", "s2")
+	other.Endpoint = "https://fcm.googleapis.com/fcm/send/s2"
+	if err := s.AddSubscriptions([]push.Subscription{
+		testSubscription("news", "s1"),
+		other,
+		testSubscription("news.*", "w1"),
+		testSubscription("sports", "s3"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	notification := push.Notification{Topic: "news", ID: "n1", Time: time.Now().Add(time.Hour)}
+	if err := s.AddNotification("news", notification); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, s, counts{
+		subscriptions: map[string]int{"*": 4, "news": 2, "news.*": 1, "sports": 1},
+		notifications: map[string]int{"*": 1, "news": 1},
+		topics:        2,
+		hosts:         map[string]int{"fcm.googleapis.com": 1, "push.example.com": 3},
+	})
+
+	// rewriting a record counts it once, under its new endpoint
+	other.Endpoint = "https://push.example.com/news/s2"
+	if err := s.AddSubscriptions([]push.Subscription{other}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddNotification("news", notification); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, s, counts{
+		subscriptions: map[string]int{"*": 4, "news": 2},
+		notifications: map[string]int{"*": 1, "news": 1},
+		topics:        2,
+		hosts:         map[string]int{"push.example.com": 4},
+	})
+
+	var b Batch
+	b.DeleteSubscription(testSubscription("sports", "s3"))
+	b.DeleteNotification(notification)
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, s, counts{
+		subscriptions: map[string]int{"*": 3, "news": 2, "sports": 0},
+		notifications: map[string]int{"*": 0, "news": 0},
+		topics:        1,
+		hosts:         map[string]int{"push.example.com": 3},
+	})
+
+	if err := s.DeleteTopic("news"); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, s, counts{
+		subscriptions: map[string]int{"*": 0, "news": 0, "news.*": 0},
+		topics:        0,
+		hosts:         map[string]int{},
+	})
+}
+
+func TestRecount(t *testing.T) {
+	s := newTestStore(t)
+	seedTopic(t, s, "news")
+	seedTopic(t, s, "sports")
+
+	// counters lost, as in databases from before they were kept
+	var b Batch
+	b.DeletePrefix(string(KeyCount) + ":")
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, s, counts{topics: 0, hosts: map[string]int{}})
+
+	if err := s.db.Update(recount); err != nil {
+		t.Fatalf("recount: %v", err)
+	}
+	checkCounts(t, s, counts{
+		subscriptions: map[string]int{"*": 2, "news": 1, "sports": 1},
+		notifications: map[string]int{"*": 2, "news": 1},
+		topics:        2,
+		hosts:         map[string]int{"push.example.com": 2},
+	})
+}
@@ -0,0 +1,356 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+// Secrets are encrypted at rest with envelope encryption: the VAPID private
+// keys and the auth and p256dh keys of subscriptions are encrypted with a
+// random data key, which is stored encrypted with a master key the store
+// never holds. Rotating the master key replaces the data key too, and
+// re-encrypts every secret with it. Endpoints stay in plain text, for the
+// indexes and counters.
+
+// MasterKeySize is the length of a master key, an AES-256 key.
+const MasterKeySize = 32
+
+// prefix of encrypted fields, which base64url keys never contain
+const sealedPrefix = "enc:"
+
+var (
+	// ErrMasterKeyRequired is returned when opening an encrypted store without its master key.
+	ErrMasterKeyRequired = errors.New("database secrets are encrypted, a master key is required")
+	// ErrWrongMasterKey is returned when the master key does not decrypt the data key.
+	ErrWrongMasterKey = errors.New("master key does not decrypt the database")
+)
+
+// GenerateMasterKey returns a random master key, base64 encoded.
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, MasterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseMasterKey decodes a base64 encoded master key.
+func ParseMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %v", err)
+	}
+	if len(key) != MasterKeySize {
+		return nil, fmt.Errorf("invalid master key: %d bytes, need %d", len(key), MasterKeySize)
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt returns the nonce followed by the ciphertext, bound to context.
+func encrypt(aead cipher.AEAD, plaintext, context []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, context), nil
+}
+
+func decrypt(aead cipher.AEAD, sealed, context []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, context)
+}
+
+// unlock decrypts the data key of an encrypted store with the master key.
+// A master key for a store that isn't encrypted is left for Rekey.
+func (s *Store) unlock(masterKey []byte) error {
+	wrapped, err := s.Get(string(KeyDataKey))
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if masterKey == nil {
+		return ErrMasterKeyRequired
+	}
+
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(wrapped))
+	if err != nil {
+		return fmt.Errorf("invalid data key: %v", err)
+	}
+	dataKey, err := decrypt(master, sealed, []byte(KeyDataKey))
+	if err != nil {
+		return ErrWrongMasterKey
+	}
+
+	s.dataKey, err = newAEAD(dataKey)
+	return err
+}
+
+// Encrypted reports whether the secrets of the store are encrypted.
+func (s *Store) Encrypted() bool {
+	return s.dataKey != nil
+}
+
+// secretFields returns the fields of a decoded record that are kept encrypted.
+func secretFields(record interface{}) []*string {
+	switch r := record.(type) {
+	case *push.Subscription:
+		return []*string{&r.Keys.Auth, &r.Keys.P256dh}
+	case *push.VapidKeys:
+		return []*string{&r.VAPIDPrivateKey}
+	}
+	return nil
+}
+
+// secretRecord returns an empty record of the kind kept at key, nil for
+// kinds without secrets.
+func secretRecord(key string) interface{} {
+	parts := strings.Split(key, ":")
+
+	switch {
+	case parts[0] == string(KeyVapidKeys):
+		return &push.VapidKeys{}
+	case parts[0] == string(KeyTopic) && len(parts) == 4 && (parts[2] == string(KeySubscription) || parts[2] == string(KeyWildcard)):
+		return &push.Subscription{}
+	}
+	return nil
+}
+
+// sealFields encrypts the fields in place, bound to the key of their record.
+// Empty and already encrypted fields are left as they are.
+func sealFields(aead cipher.AEAD, key string, fields []*string) error {
+	for _, field := range fields {
+		if *field == "" || strings.HasPrefix(*field, sealedPrefix) {
+			continue
+		}
+		sealed, err := encrypt(aead, []byte(*field), []byte(key))
+		if err != nil {
+			return err
+		}
+		*field = sealedPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+	}
+	return nil
+}
+
+// openFields decrypts the fields in place, fields in plain text are left as
+// they are.
+func openFields(aead cipher.AEAD, key string, fields []*string) error {
+	for _, field := range fields {
+		encoded, ok := strings.CutPrefix(*field, sealedPrefix)
+		if !ok {
+			continue
+		}
+		if aead == nil {
+			return errors.New("field is encrypted but the database has no data key")
+		}
+		sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid encrypted field: %v", err)
+		}
+		plaintext, err := decrypt(aead, sealed, []byte(key))
+		if err != nil {
+			return fmt.Errorf("decrypt field: %v", err)
+		}
+		*field = string(plaintext)
+	}
+	return nil
+}
+
+// unmarshal decodes a stored record and decrypts its secrets.
+func (s *Store) unmarshal(key, value string, v interface{}) error {
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return err
+	}
+	return openFields(s.dataKey, key, secretFields(v))
+}
+
+// seal encrypts the secrets of a record about to be stored at key. Values
+// that don't decode are stored as they are, and quarantined when read.
+func (s *Store) seal(key, value string) (string, error) {
+	record := secretRecord(key)
+	if s.dataKey == nil || record == nil {
+		return value, nil
+	}
+	if err := json.Unmarshal([]byte(value), record); err != nil {
+		return value, nil
+	}
+
+	if err := sealFields(s.dataKey, key, secretFields(record)); err != nil {
+		return "", err
+	}
+	val, err := json.Marshal(record)
+	return string(val), err
+}
+
+// reveal returns a stored record with its secrets decrypted.
+func (s *Store) reveal(key, value string) (string, error) {
+	record := secretRecord(key)
+	if s.dataKey == nil || record == nil {
+		return value, nil
+	}
+	if err := s.unmarshal(key, value, record); err != nil {
+		return "", fmt.Errorf("%s: %w", key, err)
+	}
+	val, err := json.Marshal(record)
+	return string(val), err
+}
+
+// Rekey encrypts the secrets of every record with a new data key, itself
+// encrypted with masterKey, in a single transaction, and returns the number
+// of records rewritten. A nil masterKey decrypts them instead. It encrypts a
+// store for the first time as well as rotating its master key, and must not
+// run while the store is used elsewhere. The file is compacted after, so the
+// previous values don't linger in it. Encrypting drops the values of the
+// quarantined records that may hold secrets, which stay readable otherwise.
+func (s *Store) Rekey(masterKey []byte) (int, error) {
+	var dataKey cipher.AEAD
+	wrapped := ""
+	if masterKey != nil {
+		master, err := newAEAD(masterKey)
+		if err != nil {
+			return 0, err
+		}
+		key := make([]byte, MasterKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return 0, err
+		}
+		if dataKey, err = newAEAD(key); err != nil {
+			return 0, err
+		}
+		sealed, err := encrypt(master, key, []byte(KeyDataKey))
+		if err != nil {
+			return 0, err
+		}
+		wrapped = base64.StdEncoding.EncodeToString(sealed)
+	}
+
+	count := 0
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		records := make(map[string]string)
+		collect := func(key, value string) bool {
+			records[key] = value
+			return true
+		}
+		patterns := append([]string{string(KeyVapidKeys), GetVapidKeyPairKey("*")}, subscriptionPatterns("*")...)
+		for _, pattern := range patterns {
+			if err := tx.AscendKeys(pattern, collect); err != nil {
+				return err
+			}
+		}
+
+		for key, value := range records {
+			record := secretRecord(key)
+			fields := secretFields(record)
+			err := json.Unmarshal([]byte(value), record)
+			if err == nil {
+				err = openFields(s.dataKey, key, fields)
+			}
+			if err != nil {
+				// its secrets are lost with the old data key either way
+				bad := Quarantined{Key: key, Value: value, Error: err.Error(), QuarantinedAt: time.Now().UTC()}
+				if err := quarantineTx(tx, bad); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if dataKey != nil {
+				if err := sealFields(dataKey, key, fields); err != nil {
+					return err
+				}
+			}
+			val, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := setTx(tx, key, string(val), nil); err != nil {
+				return err
+			}
+			count++
+		}
+
+		if dataKey != nil {
+			if err := dropQuarantinedSecretsTx(tx); err != nil {
+				return err
+			}
+		}
+
+		if wrapped == "" {
+			err := deleteTx(tx, string(KeyDataKey))
+			if err == buntdb.ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		return setTx(tx, string(KeyDataKey), wrapped, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.dataKey = dataKey
+	return count, s.db.Shrink()
+}
+
+// dropQuarantinedSecretsTx clears the values of the quarantined records of
+// kinds with secrets, which failed to decode and so can't be encrypted.
+func dropQuarantinedSecretsTx(tx *buntdb.Tx) error {
+	records := make([]Quarantined, 0)
+	var decodeErr error
+	err := tx.AscendKeys(GetQuarantineKey("*"), func(key, value string) bool {
+		var record Quarantined
+		if decodeErr = json.Unmarshal([]byte(value), &record); decodeErr != nil {
+			return false
+		}
+		if record.Value != "" && secretRecord(record.Key) != nil {
+			records = append(records, record)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	for _, record := range records {
+		record.Value = ""
+		record.Error += " (value dropped when encrypting, it may hold secrets)"
+		val, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := setTx(tx, GetQuarantineKey(record.Key), string(val), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
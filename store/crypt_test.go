@@ -0,0 +1,175 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+func testMasterKey(t *testing.T) []byte {
+	t.Helper()
+	encoded, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseMasterKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// reopen closes the store and opens its file again with the master key.
+func reopen(t *testing.T, s *Store, path string, masterKey []byte) *Store {
+	t.Helper()
+	s.Close()
+	s, err := Open(path, masterKey)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return s
+}
+
+// checkSecrets checks that the secrets decrypt, and whether they are stored
+// encrypted.
+func checkSecrets(t *testing.T, s *Store, vapidKeys push.VapidKeys, encrypted bool) {
+	t.Helper()
+	if s.Encrypted() != encrypted {
+		t.Errorf("got encrypted %v, want %v", s.Encrypted(), encrypted)
+	}
+
+	raw, err := s.Get(GetSubscriptionKey("news", "s1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), sealedPrefix) != encrypted || strings.Contains(string(raw), "auth-s1") == encrypted {
+		t.Errorf("got stored subscription %s, want encrypted %v", raw, encrypted)
+	}
+
+	subscription, err := s.FindSubscription("news", testSubscription("news", "s1").Endpoint)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if subscription.Keys.Auth != "auth-s1" || subscription.Keys.P256dh != "p256dh-s1" {
+		t.Errorf("got keys %+v", subscription.Keys)
+	}
+	if got, err := s.GetVapidKeys(); err != nil || got != vapidKeys {
+		t.Errorf("got vapid keys %+v, %v", got, err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+
+	vapidKeys := push.GenerateVAPIDKeys()
+	if err := s.SetVapidKeys(vapidKeys); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddSubscriptions([]push.Subscription{testSubscription("news", "s1"), testSubscription("news.*", "w1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// encrypt
+	first := testMasterKey(t)
+	if n, err := s.Rekey(first); err != nil || n != 3 {
+		t.Fatalf("encrypt: got %d, %v, want 3 records", n, err)
+	}
+	s = reopen(t, s, path, first)
+	checkSecrets(t, s, vapidKeys, true)
+	s.Close()
+
+	if _, err := Open(path, nil); !errors.Is(err, ErrMasterKeyRequired) {
+		t.Errorf("without a key: got %v, want ErrMasterKeyRequired", err)
+	}
+	second := testMasterKey(t)
+	if _, err := Open(path, second); !errors.Is(err, ErrWrongMasterKey) {
+		t.Errorf("with the wrong key: got %v, want ErrWrongMasterKey", err)
+	}
+
+	// rotate
+	s = reopen(t, s, path, first)
+	if _, err := s.Rekey(second); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	s.Close()
+	if _, err := Open(path, first); !errors.Is(err, ErrWrongMasterKey) {
+		t.Errorf("with the previous key: got %v, want ErrWrongMasterKey", err)
+	}
+	s = reopen(t, s, path, second)
+	checkSecrets(t, s, vapidKeys, true)
+
+	// decrypt
+	if _, err := s.Rekey(nil); err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	s = reopen(t, s, path, nil)
+	checkSecrets(t, s, vapidKeys, false)
+	if count, _ := s.CountSubscriptions("*"); count != 2 {
+		t.Errorf("got %d subscriptions counted, want 2", count)
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	tests := []struct {
+		encoded string
+		valid   bool
+	}{
+		{"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=", true},
+		{" AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=\n", true},
+		{"AAECAwQFBgcICQoLDA0ODw==", false},
+		{"not base64!", false},
+	}
+	for _, tt := range tests {
+		if _, err := ParseMasterKey(tt.encoded); (err == nil) != tt.valid {
+			t.Errorf("%q: got %v, want valid %v", tt.encoded, err, tt.valid)
+		}
+	}
+}
+
+func TestRekeyDropsQuarantinedSecrets(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.AddSubscriptions([]push.Subscription{testSubscription("news", "s1")}); err != nil {
+		t.Fatal(err)
+	}
+	// a subscription with its secrets in plain text that fails to decode,
+	// and a record without secrets
+	setRaw(t, s, map[string]string{
+		GetSubscriptionKey("news", "bad"): `{"keys":{"auth":"plain-auth"},"id":`,
+		GetNotificationKey("news", "bad"): `{"id":`,
+	})
+	if _, err := s.GetSubscriptions("news"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetNotifications(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Rekey(testMasterKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	records, err := s.GetQuarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, record := range records {
+		values[record.Key] = record.Value
+	}
+	if len(values) != 2 {
+		t.Fatalf("got quarantined %+v, want 2 records", records)
+	}
+	if v := values[GetSubscriptionKey("news", "bad")]; v != "" {
+		t.Errorf("got subscription value %q, want it dropped", v)
+	}
+	if v := values[GetNotificationKey("news", "bad")]; v != `{"id":` {
+		t.Errorf("got notification value %q, want it kept", v)
+	}
+}
@@ -0,0 +1,299 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+// RecordType is the kind of a line of an export.
+type RecordType string
+
+const (
+	RecordVapidKeys    RecordType = "vapidKeys"
+	RecordVapidKeyPair RecordType = "vapidKeyPair"
+	RecordTopic        RecordType = "topic"
+	RecordSubscription RecordType = "subscription"
+	RecordNotification RecordType = "notification"
+)
+
+// Record is a line of a JSON-lines export.
+type Record struct {
+	Type RecordType      `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// records imported per transaction
+const importBatchSize = 500
+
+// Export writes the VAPID keys, topics, subscriptions and pending
+// notifications as JSON lines, from a single consistent view of the store.
+// Secrets are written decrypted, so any store can import them.
+func (s *Store) Export(w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	return s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		write := func(kind RecordType) func(key, value string) bool {
+			return func(key, value string) bool {
+				var val string
+				if val, err = s.reveal(key, value); err != nil {
+					return false
+				}
+				err = enc.Encode(Record{Type: kind, Data: json.RawMessage(val)})
+				return err == nil
+			}
+		}
+
+		keys, getErr := tx.Get(string(KeyVapidKeys))
+		if getErr == nil {
+			write(RecordVapidKeys)(string(KeyVapidKeys), keys)
+		} else if getErr != buntdb.ErrNotFound {
+			return getErr
+		}
+		if err != nil {
+			return err
+		}
+
+		if iterErr := tx.AscendKeys(GetVapidKeyPairKey("*"), write(RecordVapidKeyPair)); iterErr != nil {
+			return iterErr
+		}
+		if err != nil {
+			return err
+		}
+
+		// topic records are the only keys directly below "topic:"
+		topics := write(RecordTopic)
+		iterErr := tx.AscendKeys(GetTopicKey("*"), func(key, value string) bool {
+			if strings.Count(key, ":") != 1 {
+				return true
+			}
+			return topics(key, value)
+		})
+		if iterErr != nil {
+			return iterErr
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, pattern := range subscriptionPatterns("*") {
+			if iterErr := tx.AscendKeys(pattern, write(RecordSubscription)); iterErr != nil {
+				return iterErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if iterErr := tx.AscendKeys(GetNotificationKey("*", "*"), write(RecordNotification)); iterErr != nil {
+			return iterErr
+		}
+		return err
+	})
+}
+
+// ImportError is a line of an import that could not be imported.
+type ImportError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+type ImportResult struct {
+	Imported map[RecordType]int `json:"imported"`
+	// records already in the store when merging
+	Skipped map[RecordType]int `json:"skipped"`
+	Errors  []ImportError      `json:"errors"`
+
+	// imported keys and notifications, for a running server to pick up
+	VapidKeys     *push.VapidKeys     `json:"-"`
+	VapidKeyPairs []push.VapidKeys    `json:"-"`
+	Notifications []push.Notification `json:"-"`
+}
+
+// Import reads an export. Records overwrite those with the same key, unless
+// merge is set: then existing VAPID keys and topics are kept, and
+// subscriptions are skipped when their endpoint is already subscribed to the
+// topic. Existing notifications are always kept. Lines that fail to decode
+// are reported and skipped.
+func (s *Store) Import(r io.Reader, merge bool) (ImportResult, error) {
+	result := ImportResult{
+		Imported: make(map[RecordType]int),
+		Skipped:  make(map[RecordType]int),
+		Errors:   make([]ImportError, 0),
+	}
+
+	// topics and endpoints of the lines so far, to dedupe subscriptions
+	// when merging
+	endpoints := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	batch := make([]decodedRecord, 0, importBatchSize)
+
+	flush := func() error {
+		err := s.db.Update(func(tx *buntdb.Tx) error {
+			for _, e := range batch {
+				// a running server already scheduled the notifications it has
+				if merge || e.kind == RecordNotification {
+					if _, err := tx.Get(e.key); err == nil {
+						result.Skipped[e.kind]++
+						continue
+					} else if err != buntdb.ErrNotFound {
+						return err
+					}
+				}
+				if sub, ok := e.item.(push.Subscription); ok && merge {
+					exists := false
+					err := ascendEndpoint(tx, sub.Topic, sub.Endpoint, func(key, value string) bool {
+						exists = true
+						return false
+					})
+					if err != nil {
+						return err
+					}
+					if exists {
+						result.Skipped[e.kind]++
+						continue
+					}
+				}
+				value, err := s.seal(e.key, e.value)
+				if err != nil {
+					return err
+				}
+				if err := setTx(tx, e.key, value, nil); err != nil {
+					return err
+				}
+				result.Imported[e.kind]++
+
+				switch item := e.item.(type) {
+				case push.VapidKeys:
+					if e.kind == RecordVapidKeyPair {
+						result.VapidKeyPairs = append(result.VapidKeyPairs, item)
+					} else {
+						result.VapidKeys = &item
+					}
+				case push.Notification:
+					result.Notifications = append(result.Notifications, item)
+				}
+			}
+			return nil
+		})
+		batch = batch[:0]
+		return err
+	}
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		e, err := decodeRecord([]byte(text))
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Line: line, Message: err.Error()})
+			continue
+		}
+
+		if sub, ok := e.item.(push.Subscription); ok && merge {
+			id := sub.Topic + " " + sub.Endpoint
+			if endpoints[id] {
+				result.Skipped[RecordSubscription]++
+				continue
+			}
+			endpoints[id] = true
+		}
+
+		batch = append(batch, e)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+
+	return result, flush()
+}
+
+type decodedRecord struct {
+	kind  RecordType
+	key   string
+	value string
+	item  interface{}
+}
+
+// decodeRecord checks a line of an export and finds the key it is kept at.
+func decodeRecord(line []byte) (decodedRecord, error) {
+	var record Record
+	if err := json.Unmarshal(line, &record); err != nil {
+		return decodedRecord{}, fmt.Errorf("invalid json: %v", err)
+	}
+	d := decodedRecord{kind: record.Type, value: string(record.Data)}
+
+	switch record.Type {
+	case RecordVapidKeys:
+		var keys push.VapidKeys
+		if err := json.Unmarshal(record.Data, &keys); err != nil {
+			return d, fmt.Errorf("invalid vapid keys: %v", err)
+		}
+		if err := push.ValidateVapidKeys(keys); err != nil {
+			return d, err
+		}
+		d.key, d.item = string(KeyVapidKeys), keys
+	case RecordVapidKeyPair:
+		var keys push.VapidKeys
+		if err := json.Unmarshal(record.Data, &keys); err != nil {
+			return d, fmt.Errorf("invalid vapid keys: %v", err)
+		}
+		if err := push.ValidateVapidKeys(keys); err != nil {
+			return d, err
+		}
+		d.key, d.item = GetVapidKeyPairKey(keys.VAPIDPublicKey), keys
+	case RecordTopic:
+		var topic push.Topic
+		if err := json.Unmarshal(record.Data, &topic); err != nil {
+			return d, fmt.Errorf("invalid topic: %v", err)
+		}
+		if topic.ID == "" || strings.Contains(topic.ID, ":") {
+			return d, fmt.Errorf("invalid topic id %q", topic.ID)
+		}
+		d.key, d.item = GetTopicKey(topic.ID), topic
+	case RecordSubscription:
+		var subscription push.Subscription
+		if err := json.Unmarshal(record.Data, &subscription); err != nil {
+			return d, fmt.Errorf("invalid subscription: %v", err)
+		}
+		if subscription.ID == "" || subscription.Topic == "" || subscription.Endpoint == "" {
+			return d, fmt.Errorf("subscription needs an id, topic and endpoint")
+		}
+		if err := push.ValidateKeys(&subscription.Subscription); err != nil {
+			return d, err
+		}
+		d.key, d.item = GetSubscriptionKey(subscription.Topic, subscription.ID), subscription
+	case RecordNotification:
+		var notification push.Notification
+		if err := json.Unmarshal(record.Data, &notification); err != nil {
+			return d, fmt.Errorf("invalid notification: %v", err)
+		}
+		if notification.ID == "" || notification.Topic == "" {
+			return d, fmt.Errorf("notification needs an id and topic")
+		}
+		d.key, d.item = GetNotificationEntryKey(notification), notification
+	default:
+		return d, fmt.Errorf("unknown record type %q", record.Type)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+// validSubscription is a testSubscription with keys that pass validation.
+func validSubscription(t *testing.T, topic, id string) push.Subscription {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+
+	subscription := testSubscription(topic, id)
+	subscription.Keys.P256dh = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	subscription.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+	return subscription
+}
+
+// seedExport stores one record of each kind an export has, and returns the
+// VAPID keys.
+func seedExport(t *testing.T, s *Store) push.VapidKeys {
+	t.Helper()
+	vapidKeys := push.GenerateVAPIDKeys()
+	if err := s.SetVapidKeys(vapidKeys); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddVapidKeyPair(push.GenerateVAPIDKeys()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTopic(push.Topic{ID: "news", Name: "News"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddSubscriptions([]push.Subscription{validSubscription(t, "news", "s1"), validSubscription(t, "news.*", "w1")}); err != nil {
+		t.Fatal(err)
+	}
+	notification := push.Notification{Topic: "news", ID: "n1", Time: time.Now().Add(time.Hour).UTC()}
+	if err := s.AddNotification("news", notification); err != nil {
+		t.Fatal(err)
+	}
+	return vapidKeys
+}
+
+func export(t *testing.T, s *Store) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := s.Export(&buf); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	return buf.String()
+}
+
+func newEncryptedTestStore(t *testing.T, encrypted bool) *Store {
+	t.Helper()
+	s := newTestStore(t)
+	if encrypted {
+		if _, err := s.Rekey(testMasterKey(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestExportImportRestore(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted=%v", encrypted), func(t *testing.T) {
+			src := newEncryptedTestStore(t, encrypted)
+			vapidKeys := seedExport(t, src)
+			exported := export(t, src)
+			if strings.Contains(exported, sealedPrefix) {
+				t.Errorf("export has encrypted secrets: %s", exported)
+			}
+
+			// restoring overwrites what is there, except pending notifications
+			dst := newEncryptedTestStore(t, encrypted)
+			if err := dst.SetVapidKeys(push.GenerateVAPIDKeys()); err != nil {
+				t.Fatal(err)
+			}
+			if err := dst.SetTopic(push.Topic{ID: "news", Name: "Old"}); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := dst.Import(strings.NewReader(exported+"not json\n"), false)
+			if err != nil {
+				t.Fatalf("import: %v", err)
+			}
+			want := map[RecordType]int{RecordVapidKeys: 1, RecordVapidKeyPair: 1, RecordTopic: 1, RecordSubscription: 2, RecordNotification: 1}
+			if fmt.Sprint(result.Imported) != fmt.Sprint(want) {
+				t.Errorf("got imported %v, want %v", result.Imported, want)
+			}
+			if len(result.Errors) != 1 || result.Errors[0].Line != strings.Count(exported, "\n")+1 {
+				t.Errorf("got errors %+v, want the last line", result.Errors)
+			}
+			if result.VapidKeys == nil || *result.VapidKeys != vapidKeys || len(result.VapidKeyPairs) != 1 || len(result.Notifications) != 1 {
+				t.Errorf("got %+v, want the imported keys and notification", result)
+			}
+
+			if got := export(t, dst); got != exported {
+				t.Errorf("got export\n%s\nwant\n%s", got, exported)
+			}
+			if count, _ := dst.CountSubscriptions("*"); count != 2 {
+				t.Errorf("got %d subscriptions counted, want 2", count)
+			}
+
+			// importing again keeps the pending notification already there
+			result, err = dst.Import(strings.NewReader(exported), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Skipped[RecordNotification] != 1 || result.Imported[RecordSubscription] != 2 {
+				t.Errorf("importing again: got imported %v, skipped %v", result.Imported, result.Skipped)
+			}
+		})
+	}
+}
+
+func TestExportImportMerge(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted=%v", encrypted), func(t *testing.T) {
+			src := newEncryptedTestStore(t, !encrypted)
+			seedExport(t, src)
+			exported := export(t, src)
+
+			// merging keeps the keys and topics that are there, and the
+			// subscriptions of endpoints already subscribed
+			dst := newEncryptedTestStore(t, encrypted)
+			vapidKeys := push.GenerateVAPIDKeys()
+			if err := dst.SetVapidKeys(vapidKeys); err != nil {
+				t.Fatal(err)
+			}
+			if err := dst.SetTopic(push.Topic{ID: "news", Name: "Kept"}); err != nil {
+				t.Fatal(err)
+			}
+			existing := testSubscription("news", "s1")
+			existing.ID = "other"
+			if err := dst.AddSubscriptions([]push.Subscription{existing}); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := dst.Import(strings.NewReader(exported), true)
+			if err != nil {
+				t.Fatalf("import: %v", err)
+			}
+			imported := map[RecordType]int{RecordVapidKeyPair: 1, RecordSubscription: 1, RecordNotification: 1}
+			skipped := map[RecordType]int{RecordVapidKeys: 1, RecordTopic: 1, RecordSubscription: 1}
+			if fmt.Sprint(result.Imported) != fmt.Sprint(imported) || fmt.Sprint(result.Skipped) != fmt.Sprint(skipped) {
+				t.Errorf("got imported %v, skipped %v, want %v and %v", result.Imported, result.Skipped, imported, skipped)
+			}
+
+			if got, _ := dst.GetVapidKeys(); got != vapidKeys {
+				t.Errorf("got vapid keys %+v, want them kept", got)
+			}
+			if topic, _ := dst.GetTopic("news"); topic.Name != "Kept" {
+				t.Errorf("got topic %+v, want it kept", topic)
+			}
+			subscriptions, err := dst.GetSubscriptions("*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0, len(subscriptions))
+			for _, subscription := range subscriptions {
+				ids = append(ids, subscription.ID)
+				if subscription.Keys.Auth == "" || strings.HasPrefix(subscription.Keys.Auth, sealedPrefix) {
+					t.Errorf("%s: got keys %+v", subscription.ID, subscription.Keys)
+				}
+			}
+			if fmt.Sprint(ids) != "[other w1]" {
+				t.Errorf("got subscriptions %v, want [other w1]", ids)
+			}
+
+			// merging again imports nothing
+			result, err = dst.Import(strings.NewReader(exported), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Imported) != 0 {
+				t.Errorf("merging again: got imported %v", result.Imported)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+// subscribers read per transaction while iterating
+const subscriberPageSize = 500
+
+// Subscribers iterates over everyone a notification to a topic reaches: its
+// own subscriptions, then the wildcard subscriptions of each parent topic,
+// each endpoint once. It reads a page at a time, so memory stays the same
+// however many there are, and visits keys in order, so iterating can resume
+// after the key of the last subscriber handled.
+//
+//	subscribers := store.IterateSubscribers(topic, after)
+//	for subscribers.Next() {
+//		send(subscribers.Subscription())
+//	}
+//	err := subscribers.Err()
+type Subscribers struct {
+	store *Store
+	// the topic, then the wildcard topics of its parents, nearest first
+	topics []string
+	// the topic being read and the last key read of it
+	current int
+	after   string
+
+	page []push.Subscription
+	keys []string
+	pos  int
+	err  error
+}
+
+// IterateSubscribers returns an iterator over the subscribers of a topic
+// with keys after the given one, from the start when it is empty.
+func (s *Store) IterateSubscribers(topic, after string) *Subscribers {
+	it := &Subscribers{store: s, topics: []string{topic}, pos: -1}
+	for _, parent := range ParentTopics(topic) {
+		it.topics = append(it.topics, parent+".*")
+	}
+
+	for i, t := range it.topics {
+		if strings.HasPrefix(after, GetSubscriptionKey(t, "")) {
+			it.current, it.after = i, after
+		}
+	}
+	return it
+}
+
+// IterateSubscription returns an iterator over the single subscription at
+// key, which is empty when it is gone or the key isn't after the given one.
+func (s *Store) IterateSubscription(key, after string) *Subscribers {
+	it := &Subscribers{store: s, pos: -1}
+	if after >= key {
+		return it
+	}
+
+	var subscription push.Subscription
+	switch err := s.GetStruct(key, &subscription); err {
+	case nil:
+		it.page = append(it.page, subscription)
+		it.keys = append(it.keys, key)
+	case ErrNotFound:
+	default:
+		it.err = err
+	}
+	return it
+}
+
+// Next moves to the next subscriber, and reports whether there is one.
+func (it *Subscribers) Next() bool {
+	it.pos++
+	for it.pos >= len(it.page) {
+		if it.err != nil || it.current == len(it.topics) {
+			return false
+		}
+		it.page, it.keys, it.pos = it.page[:0], it.keys[:0], 0
+		if it.err = it.fetch(); it.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscription returns the current subscriber.
+func (it *Subscribers) Subscription() push.Subscription {
+	return it.page[it.pos]
+}
+
+// Key returns the key of the current subscriber, to resume after.
+func (it *Subscribers) Key() string {
+	return it.keys[it.pos]
+}
+
+func (it *Subscribers) Err() error {
+	return it.err
+}
+
+// fetch reads the next page of subscribers, moving on to the next topic when
+// one runs out. The page may be empty before the last topic.
+func (it *Subscribers) fetch() error {
+	prefix := GetSubscriptionKey(it.topics[it.current], "")
+	pivot := prefix
+	if it.after != "" {
+		// the smallest key greater than after
+		pivot = it.after + "\x00"
+	}
+
+	d := decoder{store: it.store}
+	scanned := 0
+	err := it.store.db.View(func(tx *buntdb.Tx) error {
+		var iterErr error
+		err := tx.AscendGreaterOrEqual("", pivot, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) || scanned == subscriberPageSize {
+				return false
+			}
+			scanned++
+			it.after = key
+
+			var subscription push.Subscription
+			if !d.decode(key, value, &subscription) {
+				return true
+			}
+
+			var first bool
+			first, iterErr = it.firstReached(tx, key, subscription.Endpoint)
+			if iterErr != nil {
+				return false
+			}
+			if first {
+				it.page = append(it.page, subscription)
+				it.keys = append(it.keys, key)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return iterErr
+	})
+	if err != nil {
+		return err
+	}
+
+	if scanned < subscriberPageSize {
+		it.current++
+		it.after = ""
+	}
+	return d.quarantine()
+}
+
+// firstReached reports whether the subscription at key is the first one of
+// its endpoint that the iteration reaches.
+func (it *Subscribers) firstReached(tx *buntdb.Tx, key, endpoint string) (bool, error) {
+	for _, topic := range it.topics[:it.current+1] {
+		first := ""
+		err := ascendEndpoint(tx, topic, endpoint, func(k, value string) bool {
+			first = k
+			return false
+		})
+		if err != nil {
+			return false, err
+		}
+		if first != "" {
+			return first == key, nil
+		}
+	}
+	return true, nil
+}
+
+// GetCheckpointKey records how far the fan-out of a notification got.
+func GetCheckpointKey(notification push.Notification) string {
+	return fmt.Sprintf("%s:%s", KeyCheckpoint, GetNotificationEntryKey(notification))
+}
+
+// GetCheckpoint returns the key of the last subscriber a notification was
+// sent to before it was interrupted, empty when it wasn't.
+func (s *Store) GetCheckpoint(notification push.Notification) (string, error) {
+	key, err := s.Get(GetCheckpointKey(notification))
+	if err == ErrNotFound {
+		return "", nil
+	}
+	return string(key), err
+}
+
+func (b *Batch) SetCheckpoint(notification push.Notification, key string) {
+	b.Set(GetCheckpointKey(notification), []byte(key))
+}
+
+func (b *Batch) DeleteCheckpoint(notification push.Notification) {
+	b.Delete(GetCheckpointKey(notification))
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+// subscribers returns the ids of the subscribers a notification to the
+// topic reaches after the key, and the key of each.
+func subscribers(t *testing.T, s *Store, topic, after string) ([]string, []string) {
+	t.Helper()
+	var ids, keys []string
+	it := s.IterateSubscribers(topic, after)
+	for it.Next() {
+		ids = append(ids, it.Subscription().ID)
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterate %s: %v", topic, err)
+	}
+	return ids, keys
+}
+
+func TestIterateSubscribersHierarchy(t *testing.T) {
+	s := newTestStore(t)
+
+	shared := testSubscription("sports.football", "s1")
+	wildcard := testSubscription("sports.*", "w1")
+	// the same browser, subscribed to the topic and a parent wildcard
+	wildcard.Endpoint = shared.Endpoint
+	if err := s.AddSubscriptions([]push.Subscription{
+		shared,
+		testSubscription("sports.football", "s2"),
+		wildcard,
+		testSubscription("sports.*", "w2"),
+		testSubscription("sports.football.*", "w3"),
+		testSubscription("sports", "s3"),
+		testSubscription("sportsnews.*", "w4"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"sports.football", []string{"s1", "s2", "w2"}},
+		{"sports.football.uk", []string{"w3", "w1", "w2"}},
+		{"sports", []string{"s3"}},
+		{"sportsnews.today", []string{"w4"}},
+		{"news", nil},
+	}
+	for _, tt := range tests {
+		got, _ := subscribers(t, s, tt.topic, "")
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestIterateSubscribersResume(t *testing.T) {
+	s := newTestStore(t)
+
+	// more than a page of each, so resuming crosses pages and topics
+	var subscriptions []push.Subscription
+	for i := 0; i < subscriberPageSize+20; i++ {
+		subscriptions = append(subscriptions,
+			testSubscription("sports.football", fmt.Sprintf("s%04d", i)),
+			testSubscription("sports.*", fmt.Sprintf("w%04d", i)),
+		)
+	}
+	if err := s.AddSubscriptions(subscriptions); err != nil {
+		t.Fatal(err)
+	}
+
+	all, keys := subscribers(t, s, "sports.football", "")
+	if len(all) != len(subscriptions) {
+		t.Fatalf("got %d subscribers, want %d", len(all), len(subscriptions))
+	}
+
+	for _, i := range []int{0, subscriberPageSize - 1, subscriberPageSize + 19, subscriberPageSize + 20, len(all) - 1} {
+		rest, _ := subscribers(t, s, "sports.football", keys[i])
+		if fmt.Sprint(rest) != fmt.Sprint(all[i+1:]) {
+			t.Errorf("after %s: got %d subscribers, want the %d after it", keys[i], len(rest), len(all)-i-1)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	s := newTestStore(t)
+	notification := push.Notification{Topic: "news", ID: "n1"}
+
+	if key, err := s.GetCheckpoint(notification); err != nil || key != "" {
+		t.Fatalf("got %q, %v, want no checkpoint", key, err)
+	}
+
+	var b Batch
+	b.SetCheckpoint(notification, GetSubscriptionKey("news", "s1"))
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := s.GetCheckpoint(notification); key != GetSubscriptionKey("news", "s1") {
+		t.Errorf("got checkpoint %q", key)
+	}
+
+	b = Batch{}
+	b.DeleteCheckpoint(notification)
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := s.GetCheckpoint(notification); err != nil || key != "" {
+		t.Errorf("got %q, %v, want the checkpoint deleted", key, err)
+	}
+}
@@ -0,0 +1,215 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+const (
+	// subscriptions by endpoint, of plain and wildcard topics
+	indexEndpoint         = "endpoint"
+	indexWildcardEndpoint = "wildcardEndpoint"
+)
+
+func createIndexes(db *buntdb.DB) error {
+	if err := db.CreateIndex(indexEndpoint, GetSubscriptionKey("*", "*"), buntdb.IndexJSONCaseSensitive("endpoint")); err != nil {
+		return err
+	}
+	return db.CreateIndex(indexWildcardEndpoint, GetWildcardSubscriptionKey("*", "*"), buntdb.IndexJSONCaseSensitive("endpoint"))
+}
+
+// GetDueKey orders pending notifications by the time they are due, the key
+// of the notification is kept after the time.
+func GetDueKey(due time.Time, key string) string {
+	nanos := int64(0)
+	if due.After(time.Unix(0, 0)) {
+		nanos = due.UnixNano()
+	}
+	return fmt.Sprintf("%s:%020d:%s", KeyDue, nanos, key)
+}
+
+// parseDueKey returns the time and notification key of a due key.
+func parseDueKey(dueKey string) (time.Time, string) {
+	parts := strings.SplitN(dueKey, ":", 3)
+	if len(parts) != 3 {
+		return time.Time{}, ""
+	}
+	nanos, _ := strconv.ParseInt(parts[1], 10, 64)
+	if nanos == 0 {
+		return time.Time{}, parts[2]
+	}
+	return time.Unix(0, nanos).UTC(), parts[2]
+}
+
+// dueAt returns when a stored notification is sent, the zero time for right
+// away. Records that don't decode are due first, to be quarantined early.
+func dueAt(value string) time.Time {
+	var notification struct {
+		Time      time.Time `json:"time"`
+		LocalTime bool      `json:"localTime"`
+		Timezone  string    `json:"timezone"`
+	}
+	if err := json.Unmarshal([]byte(value), &notification); err != nil {
+		return time.Time{}
+	}
+	if notification.LocalTime && !notification.Time.IsZero() {
+		return push.WallTime(notification.Time, push.LoadLocation(notification.Timezone))
+	}
+	return notification.Time
+}
+
+func isNotificationKey(key string) bool {
+	return strings.HasPrefix(key, string(KeyNotification)+":")
+}
+
+// indexDueTx keeps the due key of a notification in step with its value, the
+// previous value is empty for new keys and the value for deleted ones. The
+// time is worked out once per write, not on every comparison.
+func indexDueTx(tx *buntdb.Tx, key, prev, value string) error {
+	if !isNotificationKey(key) {
+		return nil
+	}
+
+	dueKey := ""
+	if value != "" {
+		dueKey = GetDueKey(dueAt(value), key)
+	}
+	if prev != "" {
+		if prevKey := GetDueKey(dueAt(prev), key); prevKey != dueKey {
+			if _, err := tx.Delete(prevKey); err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+		}
+	}
+	if dueKey == "" {
+		return nil
+	}
+	_, _, err := tx.Set(dueKey, "", nil)
+	return err
+}
+
+// indexDue adds the missing due keys of the pending notifications.
+func indexDue(tx *buntdb.Tx) error {
+	notifications := make(map[string]string)
+	err := tx.AscendKeys(GetNotificationKey("*", "*"), func(key, value string) bool {
+		notifications[key] = value
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, value := range notifications {
+		if err := indexDueTx(tx, key, "", value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ascendDue iterates over the pending notifications in the order they are due.
+func ascendDue(tx *buntdb.Tx, iter func(due time.Time, key, value string) bool) error {
+	var getErr error
+	err := tx.AscendKeys(fmt.Sprintf("%s:*", KeyDue), func(dueKey, _ string) bool {
+		due, key := parseDueKey(dueKey)
+		value, err := tx.Get(key)
+		if err == buntdb.ErrNotFound {
+			return true
+		}
+		if err != nil {
+			getErr = err
+			return false
+		}
+		return iter(due, key, value)
+	})
+	if err != nil {
+		return err
+	}
+	return getErr
+}
+
+func endpointPivot(endpoint string) string {
+	pivot, _ := json.Marshal(map[string]string{"endpoint": endpoint})
+	return string(pivot)
+}
+
+// ascendEndpoint iterates over the subscriptions of the topic with the endpoint.
+func ascendEndpoint(tx *buntdb.Tx, topic, endpoint string, iter func(key, value string) bool) error {
+	index := indexEndpoint
+	if strings.HasSuffix(topic, ".*") {
+		index = indexWildcardEndpoint
+	}
+	prefix := GetSubscriptionKey(topic, "")
+
+	return tx.AscendEqual(index, endpointPivot(endpoint), func(key, value string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		return iter(key, value)
+	})
+}
+
+// FindSubscription returns the subscription of the topic with the endpoint.
+func (s *Store) FindSubscription(topic, endpoint string) (push.Subscription, error) {
+	var subscription push.Subscription
+	found := false
+	d := decoder{store: s}
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return ascendEndpoint(tx, topic, endpoint, func(key, value string) bool {
+			found = d.decode(key, value, &subscription)
+			return !found
+		})
+	})
+	if err != nil {
+		return subscription, err
+	}
+	if err := d.quarantine(); err != nil {
+		return subscription, err
+	}
+	if !found {
+		return subscription, ErrNotFound
+	}
+	return subscription, nil
+}
+
+// GetDueNotifications returns up to limit pending notifications in the
+// order they are due, across all topics.
+func (s *Store) GetDueNotifications(limit int) ([]push.Notification, error) {
+	notifications := make([]push.Notification, 0, limit)
+	d := decoder{store: s}
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return ascendDue(tx, func(due time.Time, key, value string) bool {
+			var notification push.Notification
+			if d.decode(key, value, &notification) {
+				notifications = append(notifications, notification)
+			}
+			return len(notifications) < limit
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return notifications, d.quarantine()
+}
+
+// NextDue returns when the next pending notification is due, and false
+// when there is none.
+func (s *Store) NextDue() (time.Time, bool, error) {
+	var due time.Time
+	found := false
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return ascendDue(tx, func(at time.Time, key, value string) bool {
+			due, found = at, true
+			return false
+		})
+	})
+	return due, found, err
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+func dueIDs(t *testing.T, s *Store) []string {
+	t.Helper()
+	notifications, err := s.GetDueNotifications(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(notifications))
+	for _, notification := range notifications {
+		ids = append(ids, notification.ID)
+	}
+	return ids
+}
+
+func TestDueNotifications(t *testing.T) {
+	s := newTestStore(t)
+	base := time.Now().UTC().Truncate(time.Hour).Add(48 * time.Hour)
+	wall := time.Date(base.Year(), base.Month(), base.Day(), 9, 0, 0, 0, time.UTC)
+
+	var b Batch
+	for _, notification := range []push.Notification{
+		{Topic: "news", ID: "later", Time: wall.Add(24 * time.Hour)},
+		{Topic: "news", ID: "now"},
+		// 9:00 in Tokyo is 0:00 UTC, in New York 13:00 or 14:00 UTC
+		{Topic: "news", ID: "tokyo", Time: wall, LocalTime: true, Timezone: "Asia/Tokyo"},
+		{Topic: "sports", ID: "newyork", Time: wall, LocalTime: true, Timezone: "America/New_York"},
+		{Topic: "sports", ID: "utc", Time: wall},
+	} {
+		b.AddNotification(notification)
+	}
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[now tokyo utc newyork later]"
+	if got := fmt.Sprint(dueIDs(t, s)); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if due, ok, err := s.NextDue(); err != nil || !ok || !due.IsZero() {
+		t.Errorf("next due: got %v, %v, %v, want right away", due, ok, err)
+	}
+
+	// rescheduling moves a notification, and sending it removes it
+	b = Batch{}
+	b.AddNotification(push.Notification{Topic: "news", ID: "later", Time: base.Add(-47 * time.Hour)})
+	b.DeleteNotification(push.Notification{Topic: "news", ID: "now"})
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	want = "[later tokyo utc newyork]"
+	if got := fmt.Sprint(dueIDs(t, s)); got != want {
+		t.Errorf("after changes: got %s, want %s", got, want)
+	}
+	if due, _, _ := s.NextDue(); !due.Equal(base.Add(-47 * time.Hour)) {
+		t.Errorf("next due: got %v, want %v", due, base.Add(-47*time.Hour))
+	}
+
+	// deleting the topic removes the due keys of its notifications
+	if err := s.DeleteTopic("news"); err != nil {
+		t.Fatal(err)
+	}
+	want = "[utc newyork]"
+	if got := fmt.Sprint(dueIDs(t, s)); got != want {
+		t.Errorf("after deleting news: got %s, want %s", got, want)
+	}
+	keys, err := s.AscendBy(string(KeyDue) + ":*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("got %d due keys, want 2", len(keys))
+	}
+}
+
+func TestIndexDueMigration(t *testing.T) {
+	s := newTestStore(t)
+	// notifications written before the due keys
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		for _, value := range []string{
+			`{"topic":"news","id":"b","time":"2030-01-02T00:00:00Z"}`,
+			`{"topic":"news","id":"a","time":"2030-01-01T00:00:00Z"}`,
+		} {
+			var notification push.Notification
+			if err := json.Unmarshal([]byte(value), &notification); err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(GetNotificationEntryKey(notification), value, nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set(string(KeySchemaVersion), "4", nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := dueIDs(t, s); len(ids) != 0 {
+		t.Fatalf("got %v before migrating, want none", ids)
+	}
+
+	if _, err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(dueIDs(t, s)); got != "[a b]" {
+		t.Errorf("got %s, want [a b]", got)
+	}
+}
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+// Migration upgrades the stored records to its version. Each runs in a
+// single transaction, together with recording the new version.
+type Migration struct {
+	Version     int
+	Description string
+	up          func(tx *buntdb.Tx) error
+}
+
+// migrations in version order, databases from before versioning are version 0
+var migrations = []Migration{
+	{Version: 1, Description: "quarantine records that don't decode", up: quarantineUndecodable},
+	{Version: 2, Description: "start the age of subscriptions without a refresh time", up: backfillRefreshedAt},
+	{Version: 3, Description: "count subscriptions, notifications and topics", up: recount},
+	// nothing to change, but older builds would send with encrypted keys
+	{Version: 4, Description: "allow encrypting secrets at rest", up: func(tx *buntdb.Tx) error { return nil }},
+	{Version: 5, Description: "index pending notifications by due time", up: indexDue},
+}
+
+// SchemaVersion is the version of the records this build reads and writes.
+var SchemaVersion = migrations[len(migrations)-1].Version
+
+// ErrSchemaTooNew is returned when opening a database written by a newer build.
+var ErrSchemaTooNew = errors.New("database schema is newer than this build supports")
+
+func schemaVersion(tx *buntdb.Tx) (int, error) {
+	val, err := tx.Get(string(KeySchemaVersion))
+	if err == buntdb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+// SchemaVersion returns the version of the stored records.
+func (s *Store) SchemaVersion() (int, error) {
+	version := 0
+	err := s.db.View(func(tx *buntdb.Tx) (err error) {
+		version, err = schemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+// Migrate runs the migrations the database hasn't had yet, in order, and
+// returns them. A failed migration is rolled back and stops the later ones.
+func (s *Store) Migrate() ([]Migration, error) {
+	applied := make([]Migration, 0)
+	for _, migration := range migrations {
+		ran := false
+		err := s.db.Update(func(tx *buntdb.Tx) error {
+			version, err := schemaVersion(tx)
+			if err != nil {
+				return err
+			}
+			if version >= migration.Version {
+				return nil
+			}
+
+			if err := migration.up(tx); err != nil {
+				return err
+			}
+			_, _, err = tx.Set(string(KeySchemaVersion), strconv.Itoa(migration.Version), nil)
+			ran = err == nil
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		if ran {
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+// quarantineUndecodable moves the topics, subscriptions and notifications
+// that no longer decode out of the way of the lists they are in.
+func quarantineUndecodable(tx *buntdb.Tx) error {
+	now := time.Now().UTC()
+	bad := make([]Quarantined, 0)
+	check := func(decode func(value string) error) func(key, value string) bool {
+		return func(key, value string) bool {
+			if err := decode(value); err != nil {
+				bad = append(bad, Quarantined{Key: key, Value: value, Error: err.Error(), QuarantinedAt: now})
+			}
+			return true
+		}
+	}
+
+	topics := check(func(value string) error { return json.Unmarshal([]byte(value), &push.Topic{}) })
+	err := tx.AscendKeys(GetTopicKey("*"), func(key, value string) bool {
+		// topic records are the only keys directly below "topic:"
+		if strings.Count(key, ":") != 1 {
+			return true
+		}
+		return topics(key, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	subscriptions := check(func(value string) error { return json.Unmarshal([]byte(value), &push.Subscription{}) })
+	for _, pattern := range subscriptionPatterns("*") {
+		if err := tx.AscendKeys(pattern, subscriptions); err != nil {
+			return err
+		}
+	}
+
+	notifications := check(func(value string) error { return json.Unmarshal([]byte(value), &push.Notification{}) })
+	if err := tx.AscendKeys(GetNotificationKey("*", "*"), notifications); err != nil {
+		return err
+	}
+	if err := tx.AscendKeys(GetHistoryPrefix("*")+"*", notifications); err != nil {
+		return err
+	}
+
+	for _, record := range bad {
+		if err := quarantineTx(tx, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillRefreshedAt sets the refresh time of subscriptions stored before it
+// was tracked, so that MAX_SUBSCRIPTION_AGE counts from the migration on.
+func backfillRefreshedAt(tx *buntdb.Tx) error {
+	now := time.Now().UTC()
+	updated := make(map[string]string)
+	for _, pattern := range subscriptionPatterns("*") {
+		var encodeErr error
+		err := tx.AscendKeys(pattern, func(key, value string) bool {
+			var subscription push.Subscription
+			if err := json.Unmarshal([]byte(value), &subscription); err != nil || !subscription.RefreshedAt.IsZero() {
+				return true
+			}
+
+			subscription.RefreshedAt = now
+			if subscription.CreatedAt.IsZero() {
+				subscription.CreatedAt = now
+			}
+			val, err := json.Marshal(subscription)
+			if err != nil {
+				encodeErr = err
+				return false
+			}
+			updated[key] = string(val)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if encodeErr != nil {
+			return encodeErr
+		}
+	}
+
+	for key, value := range updated {
+		if err := setTx(tx, key, value, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+// setRaw stores values as they are, the way an older build could have.
+func setRaw(t *testing.T, s *Store, values map[string]string) {
+	t.Helper()
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		for key, value := range values {
+			if err := setTx(tx, key, value, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	s := newTestStore(t)
+	setRaw(t, s, map[string]string{
+		GetSubscriptionKey("news", "s1"): `{"id":"s1","topic":"news","endpoint":"https://push.example.com/s1","keys":{"auth":"a","p256dh":"p"}}`,
+		GetSubscriptionKey("news", "s2"): `{"id":"s2","topic":`,
+		GetNotificationKey("news", "n1"): `not json`,
+	})
+
+	applied, err := s.Migrate()
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("applied %d migrations, want %d", len(applied), len(migrations))
+	}
+	if version, _ := s.SchemaVersion(); version != SchemaVersion {
+		t.Errorf("got version %d, want %d", version, SchemaVersion)
+	}
+
+	quarantined, err := s.GetQuarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 2 || quarantined[0].Key != GetNotificationKey("news", "n1") || quarantined[1].Key != GetSubscriptionKey("news", "s2") {
+		t.Errorf("got quarantined %+v", quarantined)
+	}
+
+	subscriptions, err := s.GetSubscriptions("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0].RefreshedAt.IsZero() {
+		t.Errorf("got %+v, want s1 with a refresh time", subscriptions)
+	}
+	if count, _ := s.CountSubscriptions("news"); count != 1 {
+		t.Errorf("got %d subscriptions counted, want 1", count)
+	}
+
+	applied, err = s.Migrate()
+	if err != nil || len(applied) != 0 {
+		t.Errorf("migrating again: got %d applied, %v", len(applied), err)
+	}
+}
+
+func TestOpenSchemaTooNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(string(KeySchemaVersion), []byte(strconv.Itoa(SchemaVersion+1))); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if _, err := Open(path, nil); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("got %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestQuarantineOnRead(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddSubscriptions([]push.Subscription{testSubscription("news", "s1")}); err != nil {
+		t.Fatal(err)
+	}
+	setRaw(t, s, map[string]string{GetSubscriptionKey("news", "s2"): `{"id":1}`})
+
+	subscriptions, err := s.GetSubscriptions("news")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0].ID != "s1" {
+		t.Errorf("got %+v, want s1", subscriptions)
+	}
+
+	quarantined, err := s.GetQuarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 || quarantined[0].Key != GetSubscriptionKey("news", "s2") || quarantined[0].Error == "" {
+		t.Errorf("got quarantined %+v", quarantined)
+	}
+	if _, err := s.Get(GetSubscriptionKey("news", "s2")); err != ErrNotFound {
+		t.Errorf("got %v, want the record moved", err)
+	}
+	if count, _ := s.CountSubscriptions("news"); count != 1 {
+		t.Errorf("got %d subscriptions counted, want 1", count)
+	}
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	buntdb "github.com/tidwall/buntdb"
+)
+
+// Quarantined is a record that failed to decode, moved aside with the error
+// so the lists it was in keep working. It stays until a migration or an
+// operator deals with it.
+type Quarantined struct {
+	Key           string    `json:"key"`
+	Value         string    `json:"value"`
+	Error         string    `json:"error"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+func GetQuarantineKey(key string) string {
+	return fmt.Sprintf("%s:%s", KeyQuarantine, key)
+}
+
+func quarantineTx(tx *buntdb.Tx, record Quarantined) error {
+	// the record may have been rewritten or deleted since it was read
+	value, err := tx.Get(record.Key)
+	if err == buntdb.ErrNotFound || (err == nil && value != record.Value) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := deleteTx(tx, record.Key); err != nil {
+		return err
+	}
+	return setTx(tx, GetQuarantineKey(record.Key), string(val), nil)
+}
+
+// quarantine moves records that failed to decode to quarantine.
+func (s *Store) quarantine(records []Quarantined) error {
+	if len(records) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		for _, record := range records {
+			if err := quarantineTx(tx, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// decoder collects the records a list of the store fails to decode, to
+// quarantine them once the list is read.
+type decoder struct {
+	store *Store
+	bad   []Quarantined
+}
+
+// decode unmarshals a record and decrypts its secrets, and reports whether
+// it decoded.
+func (d *decoder) decode(key, value string, v interface{}) bool {
+	if err := d.store.unmarshal(key, value, v); err != nil {
+		d.bad = append(d.bad, Quarantined{Key: key, Value: value, Error: err.Error(), QuarantinedAt: time.Now().UTC()})
+		return false
+	}
+	return true
+}
+
+func (d *decoder) quarantine() error {
+	return d.store.quarantine(d.bad)
+}
+
+// GetQuarantined returns the quarantined records in key order.
+func (s *Store) GetQuarantined() ([]Quarantined, error) {
+	records := make([]Quarantined, 0)
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var decodeErr error
+		err := tx.AscendKeys(GetQuarantineKey("*"), func(key, value string) bool {
+			var record Quarantined
+			if decodeErr = json.Unmarshal([]byte(value), &record); decodeErr != nil {
+				return false
+			}
+			records = append(records, record)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return decodeErr
+	})
+	return records, err
+}
+
+func (s *Store) CountQuarantined() (int, error) {
+	return s.Count(GetQuarantineKey("*"))
+}
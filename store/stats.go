@@ -0,0 +1,135 @@
+package store
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+)
+
+// SentNotification is kept for each sent notification so that events
+// reported by service workers can be attributed to its topic.
+type SentNotification struct {
+	ID       string    `json:"id"`
+	Topic    string    `json:"topic"`
+	SentAt   time.Time `json:"sentAt"`
+	Variants []string  `json:"variants,omitempty"`
+}
+
+// AddSent records a sent notification for the retention period, the first
+// send of a notification split into batches wins.
+func (s *Store) AddSent(sent SentNotification, retention time.Duration) error {
+	_, err := s.SetStructIfAbsent(GetSentKey(sent.ID), sent, retention)
+	return err
+}
+
+func (s *Store) GetSent(id string) (SentNotification, error) {
+	var sent SentNotification
+	err := s.GetStruct(GetSentKey(id), &sent)
+	return sent, err
+}
+
+// IncrStats counts events of a sent notification, of its variant if any,
+// and of its topic. The notification's counts expire after the retention
+// period, the topic's stay.
+func (s *Store) IncrStats(sent SentNotification, variant string, event push.Event, by int, retention time.Duration) error {
+	var b Batch
+	b.IncrStats(sent, variant, event, by, retention)
+	return s.Apply(&b)
+}
+
+func (b *Batch) IncrStats(sent SentNotification, variant string, event push.Event, by int, retention time.Duration) {
+	b.Incr(GetNotificationStatsKey(sent.ID, event), by, retention)
+	if variant != "" {
+		b.Incr(GetVariantStatsKey(sent.ID, variant, event), by, retention)
+	}
+	b.Incr(GetTopicStatsKey(sent.Topic, event), by, 0)
+}
+
+// HasVariant reports whether the notification was sent with the variant.
+func (sent SentNotification) HasVariant(variant string) bool {
+	for _, id := range sent.Variants {
+		if id == variant {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) GetNotificationStats(id string) (push.Stats, error) {
+	return s.getStats(func(event push.Event) string {
+		return GetNotificationStatsKey(id, event)
+	})
+}
+
+func (s *Store) GetVariantStats(id, variant string) (push.Stats, error) {
+	return s.getStats(func(event push.Event) string {
+		return GetVariantStatsKey(id, variant, event)
+	})
+}
+
+func (s *Store) GetTopicStats(topic string) (push.Stats, error) {
+	return s.getStats(func(event push.Event) string {
+		return GetTopicStatsKey(topic, event)
+	})
+}
+
+func (s *Store) getStats(key func(push.Event) string) (push.Stats, error) {
+	stats := make(push.Stats, len(push.Events))
+	for _, event := range push.Events {
+		val, err := s.Get(key(event))
+		if err == ErrNotFound {
+			stats[event] = 0
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		count, err := strconv.Atoi(string(val))
+		if err != nil {
+			return nil, err
+		}
+		stats[event] = count
+	}
+	return stats, nil
+}
+
+// Click is recorded when a subscriber follows the redirect link of a
+// notification.
+type Click struct {
+	Notification string    `json:"notification"`
+	Subscription string    `json:"subscription"`
+	ClickedAt    time.Time `json:"clickedAt"`
+}
+
+// AddClick records the first click of a subscription on a notification for
+// the retention period, reporting whether it was the first.
+func (s *Store) AddClick(click Click, retention time.Duration) (bool, error) {
+	return s.SetStructIfAbsent(GetClickKey(click.Notification, click.Subscription), click, retention)
+}
+
+// Report is recorded when a service worker reports an event of a
+// notification delivered to a subscription.
+type Report struct {
+	Notification string     `json:"notification"`
+	Subscription string     `json:"subscription"`
+	Event        push.Event `json:"event"`
+	ReportedAt   time.Time  `json:"reportedAt"`
+}
+
+// AddReport records the first report of an event by a subscription for the
+// retention period, reporting whether it was the first.
+func (s *Store) AddReport(report Report, retention time.Duration) (bool, error) {
+	return s.SetStructIfAbsent(GetEventKey(report.Notification, report.Subscription, report.Event), report, retention)
+}
+
+// SetAssignment records the variant of a notification sent to a subscription.
+func (s *Store) SetAssignment(id, subscription, variant string, retention time.Duration) error {
+	return s.SetTTL(GetAssignmentKey(id, subscription), []byte(variant), retention)
+}
+
+func (s *Store) GetAssignment(id, subscription string) (string, error) {
+	variant, err := s.Get(GetAssignmentKey(id, subscription))
+	return string(variant), err
+}
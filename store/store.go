@@ -1,33 +1,142 @@
 package store
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/destruc7i0n/webpush-api/push"
+
+	buntdb "github.com/tidwall/buntdb"
 )
 
 type StoreKey string
 
 const (
-	KeyVapidKeys    StoreKey = "vapidKeys"
-	KeyTopic        StoreKey = "topic"
-	KeySubscription StoreKey = "subscription"
-	KeyNotification StoreKey = "notification"
+	KeyVapidKeys     StoreKey = "vapidKeys"
+	KeyTopic         StoreKey = "topic"
+	KeySubscription  StoreKey = "subscription"
+	KeyWildcard      StoreKey = "wildcard"
+	KeyNotification  StoreKey = "notification"
+	KeyIdempotency   StoreKey = "idempotency"
+	KeyHistory       StoreKey = "history"
+	KeyStats         StoreKey = "stats"
+	KeyClick         StoreKey = "click"
+	KeyEvent         StoreKey = "event"
+	KeyVariant       StoreKey = "variant"
+	KeyLinkSecret    StoreKey = "linkSecret"
+	KeySchemaVersion StoreKey = "schemaVersion"
+	KeyQuarantine    StoreKey = "quarantine"
+	KeyCount         StoreKey = "count"
+	KeyCheckpoint    StoreKey = "checkpoint"
+	KeyDataKey       StoreKey = "dataKey"
+	KeyDue           StoreKey = "due"
 )
 
 func GetTopicKey(topic string) string {
 	return fmt.Sprintf("%s:%s", KeyTopic, topic)
 }
 
+// GetSubscriptionKey returns the key of a subscription. Subscriptions to a
+// wildcard topic like "sports.*" are kept below their parent topic.
 func GetSubscriptionKey(topic, id string) string {
+	if parent, ok := strings.CutSuffix(topic, ".*"); ok {
+		return GetWildcardSubscriptionKey(parent, id)
+	}
 	return fmt.Sprintf("%s:%s:%s", GetTopicKey(topic), KeySubscription, id)
 }
 
+func GetWildcardSubscriptionKey(parent, id string) string {
+	return fmt.Sprintf("%s:%s:%s", GetTopicKey(parent), KeyWildcard, id)
+}
+
+// subscriptionPatterns returns the key patterns of a topic's subscriptions,
+// for "*" both the plain and wildcard subscriptions of every topic.
+func subscriptionPatterns(topic string) []string {
+	if topic == "*" {
+		return []string{GetSubscriptionKey("*", "*"), GetWildcardSubscriptionKey("*", "*")}
+	}
+	return []string{GetSubscriptionKey(topic, "*")}
+}
+
+// ParentTopics returns the ancestors of a dotted topic, nearest first.
+func ParentTopics(topic string) []string {
+	parents := make([]string, 0)
+	for i := strings.LastIndex(topic, "."); i > 0; i = strings.LastIndex(topic, ".") {
+		topic = topic[:i]
+		parents = append(parents, topic)
+	}
+	return parents
+}
+
 func GetNotificationKey(topic, id string) string {
 	return fmt.Sprintf("%s:%s:%s", KeyNotification, topic, id)
 }
 
+// GetSentKey records the topic of a sent notification, for tracking its events.
+func GetSentKey(id string) string {
+	return fmt.Sprintf("%s:%s:%s", KeyStats, KeyNotification, id)
+}
+
+func GetNotificationStatsKey(id string, event push.Event) string {
+	return fmt.Sprintf("%s:%s", GetSentKey(id), event)
+}
+
+func GetTopicStatsKey(topic string, event push.Event) string {
+	return fmt.Sprintf("%s:%s:%s:%s", KeyStats, KeyTopic, topic, event)
+}
+
+func GetVariantStatsKey(id, variant string, event push.Event) string {
+	return fmt.Sprintf("%s:%s:%s:%s", GetSentKey(id), KeyVariant, variant, event)
+}
+
+// GetAssignmentKey records the variant of a notification a subscription got.
+func GetAssignmentKey(id, subscription string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", KeyStats, KeyVariant, id, subscription)
+}
+
+func GetClickKey(id, subscription string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", KeyStats, KeyClick, id, subscription)
+}
+
+// GetEventKey records that a subscription reported an event of a
+// notification. Clicks share the key of redirect link clicks, so each counts once.
+func GetEventKey(id, subscription string, event push.Event) string {
+	if event == push.EventClicked {
+		return GetClickKey(id, subscription)
+	}
+	return fmt.Sprintf("%s:%s:%s:%s:%s", KeyStats, KeyEvent, id, subscription, event)
+}
+
+func GetHistoryPrefix(topic string) string {
+	return fmt.Sprintf("%s:%s:", KeyHistory, topic)
+}
+
+// GetHistoryKey orders a topic's sent notifications by the time they were sent.
+func GetHistoryKey(topic string, sentAt time.Time, id string) string {
+	return fmt.Sprintf("%s%020d:%s", GetHistoryPrefix(topic), sentAt.UnixNano(), id)
+}
+
+// GetIdempotencyKey scopes an idempotency key to a topic and api key.
+func GetIdempotencyKey(topic, apiKey, key string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", KeyIdempotency, topic, apiKey, key)
+}
+
+// GetNotificationEntryKey returns the key for a notification, keeping the
+// per-timezone and per-subscription parts of a notification apart.
+func GetNotificationEntryKey(notification push.Notification) string {
+	key := GetNotificationKey(notification.Topic, notification.ID)
+	if notification.SubscriptionID != "" {
+		return fmt.Sprintf("%s:%s", key, notification.SubscriptionID)
+	}
+	if notification.Timezone != "" {
+		return fmt.Sprintf("%s:%s", key, notification.Timezone)
+	}
+	return key
+}
+
 func (s *Store) GetVapidKeys() (push.VapidKeys, error) {
 	var vapidKeys push.VapidKeys
 	err := s.GetStruct(string(KeyVapidKeys), &vapidKeys)
@@ -38,26 +147,352 @@ func (s *Store) SetVapidKeys(vapidKeys push.VapidKeys) error {
 	return s.SetStruct(string(KeyVapidKeys), vapidKeys)
 }
 
-func (s *Store) GetSubscriptions(topic string) ([]push.Subscription, error) {
-	subs, err := s.AscendBy(GetSubscriptionKey(topic, "*"))
+// GetVapidKeyPairKey keeps a key pair other than the server's own.
+func GetVapidKeyPairKey(publicKey string) string {
+	return fmt.Sprintf("%s:%s", KeyVapidKeys, publicKey)
+}
+
+// AddVapidKeyPair keeps a key pair subscriptions were made with, besides the
+// server's own.
+func (s *Store) AddVapidKeyPair(keys push.VapidKeys) error {
+	return s.SetStruct(GetVapidKeyPairKey(keys.VAPIDPublicKey), keys)
+}
+
+// RotateVapidKeys makes keys the server's own in a single transaction. The
+// previous pair is kept besides it, and the subscriptions made with it are
+// marked with its public key so they can still be sent to. It returns the
+// number of subscriptions marked.
+func (s *Store) RotateVapidKeys(keys push.VapidKeys) (int, error) {
+	previous, err := s.GetVapidKeys()
+	if err == ErrNotFound {
+		return 0, s.SetVapidKeys(keys)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	marked := 0
+	var b Batch
+	b.SetStruct(GetVapidKeyPairKey(previous.VAPIDPublicKey), previous)
+	b.ops = append(b.ops, func(s *Store, tx *buntdb.Tx) error {
+		type record struct{ key, value string }
+		records := make([]record, 0)
+		for _, pattern := range subscriptionPatterns("*") {
+			err := tx.AscendKeys(pattern, func(key, value string) bool {
+				records = append(records, record{key, value})
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, r := range records {
+			// secrets are left as they are stored
+			var subscription push.Subscription
+			if err := json.Unmarshal([]byte(r.value), &subscription); err != nil {
+				// quarantined when next read
+				continue
+			}
+			if subscription.VapidKey != "" {
+				continue
+			}
+			subscription.VapidKey = previous.VAPIDPublicKey
+
+			val, err := json.Marshal(subscription)
+			if err != nil {
+				return err
+			}
+			if err := setTx(tx, r.key, string(val), nil); err != nil {
+				return err
+			}
+			marked++
+		}
+		return nil
+	})
+	b.SetStruct(string(KeyVapidKeys), keys)
+	return marked, s.Apply(&b)
+}
+
+func (s *Store) GetVapidKeyPair(publicKey string) (push.VapidKeys, error) {
+	var keys push.VapidKeys
+	err := s.GetStruct(GetVapidKeyPairKey(publicKey), &keys)
+	return keys, err
+}
+
+func (s *Store) GetVapidKeyPairs() ([]push.VapidKeys, error) {
+	pairs, err := s.AscendBy(GetVapidKeyPairKey("*"))
 	if err != nil {
 		return nil, err
 	}
 
-	subscriptions := make([]push.Subscription, 0, len(subs))
-	for _, sub := range subs {
-		var subscription push.Subscription
-		if err := json.Unmarshal([]byte(sub), &subscription); err != nil {
+	keys := make([]push.VapidKeys, 0, len(pairs))
+	for key, pair := range pairs {
+		var k push.VapidKeys
+		if err := s.unmarshal(key, pair, &k); err != nil {
 			return nil, err
 		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// GetTopic returns a registered topic, ErrNotFound for topics that only
+// exist through their subscriptions.
+func (s *Store) GetTopic(id string) (push.Topic, error) {
+	var topic push.Topic
+	err := s.GetStruct(GetTopicKey(id), &topic)
+	return topic, err
+}
+
+func (s *Store) SetTopic(topic push.Topic) error {
+	return s.SetStruct(GetTopicKey(topic.ID), topic)
+}
+
+// CreateTopic registers a topic unless it already is, and reports whether it
+// did.
+func (s *Store) CreateTopic(topic push.Topic) (bool, error) {
+	return s.SetStructIfAbsent(GetTopicKey(topic.ID), topic, 0)
+}
+
+// GetLinkSecret returns the key redirect links and tracking tokens are
+// signed with.
+func (s *Store) GetLinkSecret() ([]byte, error) {
+	secret, err := s.Get(string(KeyLinkSecret))
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(string(secret))
+}
+
+func (s *Store) SetLinkSecret(secret []byte) error {
+	return s.Set(string(KeyLinkSecret), []byte(base64.StdEncoding.EncodeToString(secret)))
+}
+
+// AddSubscriptions stores subscriptions in a single transaction.
+func (s *Store) AddSubscriptions(subscriptions []push.Subscription) error {
+	var b Batch
+	for _, subscription := range subscriptions {
+		b.SetSubscription(subscription)
+	}
+	return s.Apply(&b)
+}
+
+func (b *Batch) SetSubscription(subscription push.Subscription) {
+	b.SetStruct(GetSubscriptionKey(subscription.Topic, subscription.ID), subscription)
+}
+
+// IncrFailures counts a failed send to a subscription. The subscription is
+// read when the batch is applied, so changes made since it was fetched are
+// kept, and one deleted since is left deleted.
+func (b *Batch) IncrFailures(subscription push.Subscription) {
+	b.updateFailures(subscription, func(failures int) int { return failures + 1 })
+}
+
+// ResetFailures clears the failed sends of a subscription, like IncrFailures.
+func (b *Batch) ResetFailures(subscription push.Subscription) {
+	b.updateFailures(subscription, func(int) int { return 0 })
+}
+
+func (b *Batch) updateFailures(subscription push.Subscription, update func(failures int) int) {
+	key := GetSubscriptionKey(subscription.Topic, subscription.ID)
+	b.ops = append(b.ops, func(s *Store, tx *buntdb.Tx) error {
+		value, err := tx.Get(key)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// secrets are left as they are stored
+		var current push.Subscription
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			// quarantined when next read
+			return nil
+		}
+		failures := update(current.Failures)
+		if failures == current.Failures {
+			return nil
+		}
+		current.Failures = failures
+
+		val, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		return setTx(tx, key, string(val), nil)
+	})
+}
+
+func (b *Batch) DeleteSubscription(subscription push.Subscription) {
+	b.Delete(GetSubscriptionKey(subscription.Topic, subscription.ID))
+}
+
+// DeleteSubscriptionIf deletes a subscription if it still satisfies cond
+// when the batch is applied, so one refreshed since it was fetched is kept.
+// cond is given the subscription as stored, with its keys still sealed.
+func (b *Batch) DeleteSubscriptionIf(subscription push.Subscription, cond func(current push.Subscription) bool) {
+	key := GetSubscriptionKey(subscription.Topic, subscription.ID)
+	b.ops = append(b.ops, func(s *Store, tx *buntdb.Tx) error {
+		value, err := tx.Get(key)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var current push.Subscription
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			// quarantined when next read
+			return nil
+		}
+		if !cond(current) {
+			return nil
+		}
+		err = deleteTx(tx, key)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *Store) GetSubscriptions(topic string) ([]push.Subscription, error) {
+	return s.getSubscriptions(subscriptionPatterns(topic)...)
+}
+
+func (s *Store) getSubscriptions(patterns ...string) ([]push.Subscription, error) {
+	subscriptions := make([]push.Subscription, 0)
+	d := decoder{store: s}
+	for _, pattern := range patterns {
+		subs, err := s.AscendBy(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, sub := range subs {
+			var subscription push.Subscription
+			if d.decode(key, sub, &subscription) {
+				subscriptions = append(subscriptions, subscription)
+			}
+		}
+	}
+
+	return subscriptions, d.quarantine()
+}
+
+// GetSubscriptionsPage returns a page of a topic's subscriptions after the given key.
+func (s *Store) GetSubscriptionsPage(topic, after string, limit int, filter func(push.Subscription) bool) ([]push.Subscription, string, error) {
+	subscriptions := make([]push.Subscription, 0, limit)
+	d := decoder{store: s}
+	page, err := s.AscendPage(GetSubscriptionKey(topic, "*"), after, limit, func(key, value string) bool {
+		var subscription push.Subscription
+		if !d.decode(key, value, &subscription) {
+			return false
+		}
+		return filter == nil || filter(subscription)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := d.quarantine(); err != nil {
+		return nil, "", err
+	}
+
+	for _, entry := range page.Entries {
+		var subscription push.Subscription
+		if err := s.unmarshal(entry.Key, entry.Value, &subscription); err != nil {
+			return nil, "", err
+		}
 		subscriptions = append(subscriptions, subscription)
 	}
 
-	return subscriptions, nil
+	return subscriptions, page.Next, nil
+}
+
+// CountSubscriptions returns the number of subscriptions of a topic, of all
+// topics for "*".
+func (s *Store) CountSubscriptions(topic string) (int, error) {
+	return s.getCount(GetSubscriptionCountKey(topic))
+}
+
+// GetTopics returns up to limit topic names starting with prefix, in order,
+// after the given topic, skipping topics the filter rejects. A nil filter
+// keeps all. Topics only exist through the keys below them, those that were
+// never registered are filtered as a topic with only an ID.
+func (s *Store) GetTopics(prefix, after string, limit int, filter func(push.Topic) bool) ([]string, string, error) {
+	topics := make([]string, 0, limit)
+	next := ""
+	d := decoder{store: s}
+
+	// the keys below a topic don't sort in the order of topic names, as
+	// "topic:a:..." comes after "topic:a.b", but its counter of them does
+	base := getCountKey(countTopicKeys, "")
+	pivot := base + prefix
+	if after != "" && after >= prefix {
+		// the smallest key greater than after
+		pivot = base + after + "\x00"
+	}
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var getErr error
+		err := tx.AscendGreaterOrEqual("", pivot, func(key, value string) bool {
+			topic := strings.TrimPrefix(key, base)
+			if !strings.HasPrefix(key, base) || !strings.HasPrefix(topic, prefix) {
+				return false
+			}
+
+			if filter != nil {
+				registered := push.Topic{ID: topic}
+				value, err := tx.Get(GetTopicKey(topic))
+				if err != nil && err != buntdb.ErrNotFound {
+					getErr = err
+					return false
+				}
+				if err == nil && !d.decode(GetTopicKey(topic), value, &registered) {
+					return true
+				}
+				if !filter(registered) {
+					return true
+				}
+			}
+
+			if len(topics) == limit {
+				next = topics[limit-1]
+				return false
+			}
+			topics = append(topics, topic)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return getErr
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return topics, next, d.quarantine()
+}
+
+// CountTopics returns the number of topics.
+func (s *Store) CountTopics() (int, error) {
+	return s.getCount(getCountKey(countTopics))
 }
 
 func (s *Store) AddNotification(topic string, notification push.Notification) error {
-	return s.SetStruct(GetNotificationKey(topic, notification.ID), notification)
+	return s.SetStruct(GetNotificationEntryKey(notification), notification)
+}
+
+func (b *Batch) AddNotification(notification push.Notification) {
+	b.SetStruct(GetNotificationEntryKey(notification), notification)
+}
+
+func (b *Batch) DeleteNotification(notification push.Notification) {
+	b.Delete(GetNotificationEntryKey(notification))
 }
 
 func (s *Store) GetNotifications() ([]push.Notification, error) {
@@ -67,41 +502,111 @@ func (s *Store) GetNotifications() ([]push.Notification, error) {
 	}
 
 	resp := make([]push.Notification, 0, len(notifications))
-	for _, notification := range notifications {
+	d := decoder{store: s}
+	for key, notification := range notifications {
 		var notif push.Notification
-		if err := json.Unmarshal([]byte(notification), &notif); err != nil {
-			return nil, err
+		if d.decode(key, notification, &notif) {
+			resp = append(resp, notif)
 		}
-		resp = append(resp, notif)
 	}
 
-	return resp, nil
+	return resp, d.quarantine()
 }
 
-func (s *Store) DeleteTopic(topic string) error {
-	// delete all subscriptions
-	subs, err := s.AscendBy(GetSubscriptionKey(topic, "*"))
+// GetNotificationsPage returns a page of pending notifications after the
+// given key, across all topics when topic is "*".
+func (s *Store) GetNotificationsPage(topic, after string, limit int, filter func(push.Notification) bool) ([]push.Notification, string, error) {
+	notifications := make([]push.Notification, 0, limit)
+	d := decoder{store: s}
+	page, err := s.AscendPage(GetNotificationKey(topic, "*"), after, limit, func(key, value string) bool {
+		var notification push.Notification
+		if !d.decode(key, value, &notification) {
+			return false
+		}
+		return filter == nil || filter(notification)
+	})
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	if err := d.quarantine(); err != nil {
+		return nil, "", err
 	}
 
-	for id := range subs {
-		if err := s.Delete(id); err != nil {
-			return err
+	for _, entry := range page.Entries {
+		var notification push.Notification
+		if err := s.unmarshal(entry.Key, entry.Value, &notification); err != nil {
+			return nil, "", err
 		}
+		notifications = append(notifications, notification)
 	}
 
-	// delete all notifications
-	notifications, err := s.AscendBy(GetNotificationKey(topic, "*"))
+	return notifications, page.Next, nil
+}
+
+// CountNotifications returns the number of pending notifications of a
+// topic, of all topics for "*".
+func (s *Store) CountNotifications(topic string) (int, error) {
+	return s.getCount(GetNotificationCountKey(topic))
+}
+
+// AddHistory records a sent notification, kept for the retention period.
+func (s *Store) AddHistory(notification push.Notification, sentAt time.Time, retention time.Duration) error {
+	var b Batch
+	b.AddHistory(notification, sentAt, retention)
+	return s.Apply(&b)
+}
+
+func (b *Batch) AddHistory(notification push.Notification, sentAt time.Time, retention time.Duration) {
+	b.SetStructTTL(GetHistoryKey(notification.Topic, sentAt, notification.ID), notification, retention)
+}
+
+// GetHistory returns up to limit notifications sent to the topic since the
+// given time, oldest first.
+func (s *Store) GetHistory(topic string, since time.Time, limit int) ([]push.Notification, error) {
+	notifications := make([]push.Notification, 0, limit)
+	oldest := GetHistoryKey(topic, since, "")
+
+	d := decoder{store: s}
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		return tx.DescendKeys(GetHistoryPrefix(topic)+"*", func(key, value string) bool {
+			if len(notifications) == limit || key < oldest {
+				return false
+			}
+
+			var notification push.Notification
+			if d.decode(key, value, &notification) {
+				notifications = append(notifications, notification)
+			}
+			return true
+		})
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := d.quarantine(); err != nil {
+		return nil, err
 	}
 
-	for id := range notifications {
-		if err := s.Delete(id); err != nil {
-			return err
-		}
+	// oldest first
+	for i, j := 0, len(notifications)-1; i < j; i, j = i+1, j-1 {
+		notifications[i], notifications[j] = notifications[j], notifications[i]
 	}
 
-	return nil
+	return notifications, nil
+}
+
+// DeleteTopic deletes a topic with its subscriptions, including those to its
+// wildcard, pending notifications, history and event counts in a single
+// transaction. Keys are matched by prefix rather than by pattern, so topics
+// below it are left alone.
+func (s *Store) DeleteTopic(topic string) error {
+	var b Batch
+	b.DeletePrefix(GetSubscriptionKey(topic, ""))
+	b.DeletePrefix(GetWildcardSubscriptionKey(topic, ""))
+	b.DeletePrefix(GetNotificationKey(topic, ""))
+	b.DeletePrefix(fmt.Sprintf("%s:%s", KeyCheckpoint, GetNotificationKey(topic, "")))
+	b.DeletePrefix(GetHistoryPrefix(topic))
+	b.DeletePrefix(GetTopicStatsKey(topic, ""))
+	b.Delete(GetTopicKey(topic))
+	return s.Apply(&b)
 }
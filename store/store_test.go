@@ -0,0 +1,421 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/destruc7i0n/webpush-api/push"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func testSubscription(topic, id string) push.Subscription {
+	return push.Subscription{
+		Subscription: webpush.Subscription{
+			Endpoint: fmt.Sprintf("https://push.example.com/%s/%s", topic, id),
+			Keys:     webpush.Keys{Auth: "auth-" + id, P256dh: "p256dh-" + id},
+		},
+		ID:        id,
+		Topic:     topic,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// seedTopic stores a topic with a subscription, a pending notification, a
+// history entry, a checkpoint and an event count.
+func seedTopic(t *testing.T, s *Store, topic string) {
+	t.Helper()
+	notification := push.Notification{Topic: topic, ID: "n1", Time: time.Now().Add(time.Hour)}
+
+	var b Batch
+	b.SetStruct(GetTopicKey(topic), push.Topic{ID: topic})
+	b.SetSubscription(testSubscription(topic, "s1"))
+	b.AddNotification(notification)
+	b.AddHistory(notification, time.Now(), time.Hour)
+	b.SetCheckpoint(notification, GetSubscriptionKey(topic, "s1"))
+	b.IncrStats(SentNotification{ID: "n1", Topic: topic}, "", push.EventDelivered, 1, time.Hour)
+	if err := s.Apply(&b); err != nil {
+		t.Fatalf("seed %s: %v", topic, err)
+	}
+}
+
+func TestDeleteTopic(t *testing.T) {
+	s := newTestStore(t)
+	for _, topic := range []string{"sports", "sports.football", "sportsnews"} {
+		seedTopic(t, s, topic)
+	}
+	if err := s.AddSubscriptions([]push.Subscription{
+		testSubscription("sports.*", "w1"),
+		testSubscription("sports.football.*", "w2"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteTopic("sports"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	gone := []string{
+		GetTopicKey("sports"),
+		GetSubscriptionKey("sports", "s1"),
+		GetSubscriptionKey("sports.*", "w1"),
+		GetNotificationKey("sports", "n1"),
+		GetCheckpointKey(push.Notification{Topic: "sports", ID: "n1"}),
+		GetTopicStatsKey("sports", push.EventDelivered),
+	}
+	for _, key := range gone {
+		if _, err := s.Get(key); err != ErrNotFound {
+			t.Errorf("%s: got err %v, want it deleted", key, err)
+		}
+	}
+	if history, err := s.GetHistory("sports", time.Time{}, 10); err != nil || len(history) != 0 {
+		t.Errorf("history of sports: got %v, %v, want none", history, err)
+	}
+
+	for _, topic := range []string{"sports.football", "sportsnews"} {
+		kept := []string{
+			GetTopicKey(topic),
+			GetSubscriptionKey(topic, "s1"),
+			GetNotificationKey(topic, "n1"),
+			GetCheckpointKey(push.Notification{Topic: topic, ID: "n1"}),
+			GetTopicStatsKey(topic, push.EventDelivered),
+		}
+		for _, key := range kept {
+			if _, err := s.Get(key); err != nil {
+				t.Errorf("%s: %v, want it kept", key, err)
+			}
+		}
+		if history, err := s.GetHistory(topic, time.Time{}, 10); err != nil || len(history) != 1 {
+			t.Errorf("history of %s: got %d entries, %v, want 1", topic, len(history), err)
+		}
+	}
+	if _, err := s.Get(GetSubscriptionKey("sports.football.*", "w2")); err != nil {
+		t.Errorf("wildcard subscription of sports.football: %v, want it kept", err)
+	}
+
+	count, err := s.CountTopics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("topic count: got %d, want 2", count)
+	}
+}
+
+func TestBatchFailures(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted=%v", encrypted), func(t *testing.T) {
+			s := newTestStore(t)
+			if encrypted {
+				key, _ := GenerateMasterKey()
+				masterKey, _ := ParseMasterKey(key)
+				if _, err := s.Rekey(masterKey); err != nil {
+					t.Fatal(err)
+				}
+			}
+			testBatchFailures(t, s)
+		})
+	}
+}
+
+func testBatchFailures(t *testing.T, s *Store) {
+	stale := testSubscription("news", "s1")
+	if err := s.AddSubscriptions([]push.Subscription{stale, testSubscription("news", "s2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// refreshed with new keys and deleted while a send was in flight
+	refreshed := stale
+	refreshed.Keys.Auth = "new-auth"
+	refreshed.Timezone = "Europe/Paris"
+	var b Batch
+	b.SetSubscription(refreshed)
+	b.DeleteSubscription(testSubscription("news", "s2"))
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	b = Batch{}
+	b.IncrFailures(stale)
+	b.IncrFailures(stale)
+	b.IncrFailures(testSubscription("news", "s2"))
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptions, err := s.GetSubscriptions("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriptions) != 1 {
+		t.Fatalf("got %d subscriptions, want the deleted one to stay deleted", len(subscriptions))
+	}
+	got := subscriptions[0]
+	if got.Failures != 2 || got.Keys.Auth != "new-auth" || got.Timezone != "Europe/Paris" {
+		t.Errorf("got failures %d, auth %q, timezone %q, want 2 failures on the refreshed subscription", got.Failures, got.Keys.Auth, got.Timezone)
+	}
+
+	b = Batch{}
+	b.ResetFailures(stale)
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	subscriptions, err = s.GetSubscriptions("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions[0].Failures != 0 || subscriptions[0].Keys.Auth != "new-auth" {
+		t.Errorf("after reset: got failures %d, auth %q", subscriptions[0].Failures, subscriptions[0].Keys.Auth)
+	}
+}
+
+func TestDeleteSubscriptionIf(t *testing.T) {
+	s := newTestStore(t)
+	failing := testSubscription("news", "s1")
+	failing.Failures = 3
+	if err := s.AddSubscriptions([]push.Subscription{failing, testSubscription("news", "s2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first was sent to successfully since it was read
+	var reset Batch
+	reset.ResetFailures(failing)
+	if err := s.Apply(&reset); err != nil {
+		t.Fatal(err)
+	}
+
+	stillFailing := func(current push.Subscription) bool { return current.Failures >= 3 }
+	var b Batch
+	b.DeleteSubscriptionIf(failing, stillFailing)
+	b.DeleteSubscriptionIf(testSubscription("news", "s2"), func(push.Subscription) bool { return true })
+	b.DeleteSubscriptionIf(testSubscription("news", "gone"), func(push.Subscription) bool { return true })
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptions, err := s.GetSubscriptions("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0].ID != "s1" {
+		t.Errorf("got %+v, want only s1 kept", subscriptions)
+	}
+	if count, _ := s.CountSubscriptions("news"); count != 1 {
+		t.Errorf("got %d subscriptions counted, want 1", count)
+	}
+}
+
+func TestGetTopics(t *testing.T) {
+	s := newTestStore(t)
+	for _, topic := range []push.Topic{{ID: "sports", Archived: true}, {ID: "team1"}} {
+		if _, err := s.CreateTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddSubscriptions([]push.Subscription{
+		testSubscription("sports", "s1"),
+		testSubscription("sports.football", "s2"),
+		testSubscription("sports-news", "s3"),
+		testSubscription("sports.*", "w1"),
+		testSubscription("team1", "s4"),
+		testSubscription("team10", "s5"),
+		testSubscription("team1.a.*", "w2"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	all := []string{"sports", "sports-news", "sports.football", "team1", "team1.a", "team10"}
+	if count, _ := s.CountTopics(); count != len(all) {
+		t.Errorf("got %d topics counted, want %d", count, len(all))
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		filter func(push.Topic) bool
+		want   []string
+	}{
+		{name: "all", want: all},
+		{name: "prefix", prefix: "team1", want: []string{"team1", "team1.a", "team10"}},
+		{name: "filtered", filter: func(topic push.Topic) bool { return !topic.Archived }, want: []string{"sports-news", "sports.football", "team1", "team1.a", "team10"}},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 500} {
+			var got []string
+			after := ""
+			for {
+				page, next, err := s.GetTopics(tt.prefix, after, limit, tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) > limit {
+					t.Fatalf("%s: got a page of %d, limit %d", tt.name, len(page), limit)
+				}
+				got = append(got, page...)
+				if next == "" {
+					break
+				}
+				after = next
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("%s, limit %d: got %v, want %v", tt.name, limit, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRotateVapidKeys(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted=%v", encrypted), func(t *testing.T) {
+			s := newEncryptedTestStore(t, encrypted)
+
+			// without keys yet, there is nothing to keep
+			first := push.GenerateVAPIDKeys()
+			if marked, err := s.RotateVapidKeys(first); err != nil || marked != 0 {
+				t.Fatalf("first keys: got %d, %v", marked, err)
+			}
+
+			vendor := testSubscription("news", "v1")
+			vendor.VapidKey = "vendor-key"
+			if err := s.AddSubscriptions([]push.Subscription{testSubscription("news", "s1"), testSubscription("news.*", "w1"), vendor}); err != nil {
+				t.Fatal(err)
+			}
+
+			second := push.GenerateVAPIDKeys()
+			marked, err := s.RotateVapidKeys(second)
+			if err != nil || marked != 2 {
+				t.Fatalf("rotate: got %d, %v, want 2 subscriptions marked", marked, err)
+			}
+			if got, _ := s.GetVapidKeys(); got != second {
+				t.Errorf("got vapid keys %+v, want the new ones", got)
+			}
+			if got, err := s.GetVapidKeyPair(first.VAPIDPublicKey); err != nil || got != first {
+				t.Errorf("got previous pair %+v, %v", got, err)
+			}
+
+			subscriptions, err := s.GetSubscriptions("*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, subscription := range subscriptions {
+				want := first.VAPIDPublicKey
+				if subscription.ID == "v1" {
+					want = "vendor-key"
+				}
+				if subscription.VapidKey != want {
+					t.Errorf("%s: got vapid key %q, want %q", subscription.ID, subscription.VapidKey, want)
+				}
+				if subscription.Keys.Auth != "auth-"+subscription.ID {
+					t.Errorf("%s: got auth %q", subscription.ID, subscription.Keys.Auth)
+				}
+			}
+		})
+	}
+}
+
+func TestGetSubscriptionsPage(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted=%v", encrypted), func(t *testing.T) {
+			s := newEncryptedTestStore(t, encrypted)
+			subscriptions := []push.Subscription{testSubscription("other", "s0")}
+			for i := 1; i <= 7; i++ {
+				subscription := testSubscription("news", fmt.Sprintf("s%d", i))
+				subscription.Flagged = i%3 == 0
+				subscriptions = append(subscriptions, subscription)
+			}
+			if err := s.AddSubscriptions(subscriptions); err != nil {
+				t.Fatal(err)
+			}
+			unflagged := func(subscription push.Subscription) bool { return !subscription.Flagged }
+
+			var pages []string
+			after := ""
+			for {
+				page, next, err := s.GetSubscriptionsPage("news", after, 2, unflagged)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids := make([]string, 0, len(page))
+				for _, subscription := range page {
+					ids = append(ids, subscription.ID)
+					if subscription.Keys.Auth != "auth-"+subscription.ID {
+						t.Errorf("%s: got auth %q", subscription.ID, subscription.Keys.Auth)
+					}
+				}
+				pages = append(pages, fmt.Sprint(ids))
+				if next == "" {
+					break
+				}
+				if next != GetSubscriptionKey("news", page[len(page)-1].ID) {
+					t.Errorf("got cursor %q after %v", next, ids)
+				}
+				after = next
+			}
+			if got := fmt.Sprint(pages); got != "[[s1 s2] [s4 s5] [s7]]" {
+				t.Errorf("got pages %s", got)
+			}
+		})
+	}
+}
+
+func TestGetNotificationsPage(t *testing.T) {
+	s := newTestStore(t)
+	var b Batch
+	for i := 1; i <= 5; i++ {
+		for _, topic := range []string{"news", "sports"} {
+			b.AddNotification(push.Notification{Topic: topic, ID: fmt.Sprintf("n%d", i), Time: time.Now().Add(time.Hour)})
+		}
+	}
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	setRaw(t, s, map[string]string{GetNotificationKey("news", "n3"): `{"id":`})
+	notN2 := func(notification push.Notification) bool { return notification.ID != "n2" }
+
+	tests := []struct {
+		topic string
+		limit int
+		want  string
+	}{
+		{"news", 2, "[[news/n1 news/n4] [news/n5]]"},
+		{"*", 3, "[[news/n1 news/n4 news/n5] [sports/n1 sports/n3 sports/n4] [sports/n5]]"},
+		{"*", 7, "[[news/n1 news/n4 news/n5 sports/n1 sports/n3 sports/n4 sports/n5]]"},
+	}
+	for _, tt := range tests {
+		var pages []string
+		after := ""
+		for {
+			page, next, err := s.GetNotificationsPage(tt.topic, after, tt.limit, notN2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0, len(page))
+			for _, notification := range page {
+				ids = append(ids, notification.Topic+"/"+notification.ID)
+			}
+			pages = append(pages, fmt.Sprint(ids))
+			if next == "" {
+				break
+			}
+			after = next
+		}
+		if got := fmt.Sprint(pages); got != tt.want {
+			t.Errorf("%s by %d: got pages %s, want %s", tt.topic, tt.limit, got, tt.want)
+		}
+	}
+
+	// the record that failed to decode was quarantined
+	if count, _ := s.CountQuarantined(); count != 1 {
+		t.Errorf("got %d quarantined, want 1", count)
+	}
+}